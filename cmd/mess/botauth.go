@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenValidity is how long a bootstrap token issued by /server/token is
+// valid. The web UI tells the user it is one hour.
+const tokenValidity = time.Hour
+
+// botIdentity is the identity of an authenticated bot.
+type botIdentity struct {
+	// name is saved in Bot.AuthenticatedAs, e.g. "bot:secret/<pool>".
+	name string
+	// method is one of "localhost", "secret", "cert" or "token".
+	method string
+	// pool is the only pool the bot can be in. Empty means any pool.
+	pool string
+}
+
+// allows returns true if a bot with these dimensions can use this identity.
+func (i *botIdentity) allows(dims map[string][]string) bool {
+	if i.pool == "" {
+		return true
+	}
+	p := dims["pool"]
+	return len(p) == 1 && p[0] == i.pool
+}
+
+// botAuthenticator authenticates the requests to the bot API.
+//
+// A bot can authenticate with, in order:
+//   - a client certificate whose common name is listed in the configuration;
+//   - a shared secret listed in the configuration or a bootstrap token, sent
+//     as "Authorization: Bearer <secret>", e.g. via get_authentication_headers()
+//     in bot_config.py;
+//   - a bootstrap token as the "tok" query argument, which is what the web UI
+//     generates to download the bot code;
+//   - connecting from localhost.
+//
+// Bootstrap tokens are not bound to a pool so they can only download the bot
+// code, not call the other bot APIs.
+type botAuthenticator struct {
+	entries []botAuth
+	// key is the HMAC key to sign the bootstrap tokens.
+	key []byte
+}
+
+// newBotAuthenticator returns a botAuthenticator for the configuration.
+//
+// When no token key is configured, a random one is used so the tokens are
+// invalidated on server restart.
+func newBotAuthenticator(c *config) (*botAuthenticator, error) {
+	a := &botAuthenticator{entries: c.BotAuth, key: []byte(c.TokenKey)}
+	if len(a.key) == 0 {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// authenticate returns the identity of the bot sending the request.
+func (a *botAuthenticator) authenticate(r *http.Request, now time.Time) (botIdentity, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for i := range a.entries {
+			if e := &a.entries[i]; e.CommonName != "" && e.CommonName == cn {
+				return botIdentity{name: "bot:cert/" + cn, method: "cert", pool: e.Pool}, nil
+			}
+		}
+		return botIdentity{}, fmt.Errorf("unknown client certificate %q", cn)
+	}
+	if h := r.Header.Get("Authorization"); h != "" {
+		secret := strings.TrimPrefix(h, "Bearer ")
+		for i := range a.entries {
+			e := &a.entries[i]
+			if e.Secret != "" && subtle.ConstantTimeCompare([]byte(e.Secret), []byte(secret)) == 1 {
+				if e.Pool == "" {
+					return botIdentity{name: "bot:secret", method: "secret"}, nil
+				}
+				return botIdentity{name: "bot:secret/" + e.Pool, method: "secret", pool: e.Pool}, nil
+			}
+		}
+		if a.checkToken(secret, now) {
+			return botIdentity{name: "bot:token", method: "token"}, nil
+		}
+		return botIdentity{}, errors.New("invalid bot credential")
+	}
+	if tok := r.URL.Query().Get("tok"); tok != "" {
+		if a.checkToken(tok, now) {
+			return botIdentity{name: "bot:token", method: "token"}, nil
+		}
+		return botIdentity{}, errors.New("invalid or expired bootstrap token")
+	}
+	if isLocal(r) {
+		return botIdentity{name: "bot:localhost", method: "localhost"}, nil
+	}
+	return botIdentity{}, errors.New("missing bot credential")
+}
+
+// newToken returns a bootstrap token valid for tokenValidity.
+//
+// The token is "<expiration as unix seconds>.<base64 HMAC-SHA256>".
+func (a *botAuthenticator) newToken(now time.Time) string {
+	exp := strconv.FormatInt(now.Add(tokenValidity).Unix(), 10)
+	return exp + "." + a.sign(exp)
+}
+
+// checkToken returns true if the bootstrap token is valid and not expired.
+func (a *botAuthenticator) checkToken(tok string, now time.Time) bool {
+	exp, sig, ok := strings.Cut(tok, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.sign(exp))) {
+		return false
+	}
+	t, err := strconv.ParseInt(exp, 10, 64)
+	return err == nil && now.Before(time.Unix(t, 0))
+}
+
+func (a *botAuthenticator) sign(s string) string {
+	m := hmac.New(sha256.New, a.key)
+	m.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// loadTLSConfig returns the TLS configuration to serve HTTPS directly, or nil
+// if not configured.
+//
+// When ClientCA is set, the bots can authenticate with a client certificate
+// signed by it. Client certificates are optional so the web UI still works.
+func loadTLSConfig(c *config) (*tls.Config, error) {
+	if c.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCA != "" {
+		raw, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("%s: no certificate found", c.ClientCA)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
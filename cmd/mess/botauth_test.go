@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBotAuthenticatorToken(t *testing.T) {
+	a := &botAuthenticator{key: []byte("key")}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tok := a.newToken(now)
+	other := (&botAuthenticator{key: []byte("other")}).newToken(now)
+	data := []struct {
+		tok  string
+		now  time.Time
+		want bool
+	}{
+		{tok, now, true},
+		{tok, now.Add(tokenValidity - time.Second), true},
+		{tok, now.Add(tokenValidity), false},
+		{other, now, false},
+		{"", now, false},
+		{"1577934245", now, false},
+		{"1577934245." + a.sign("1577934246"), now, false},
+		{"x." + a.sign("x"), now, false},
+	}
+	for i, l := range data {
+		if got := a.checkToken(l.tok, l.now); got != l.want {
+			t.Errorf("#%d: %q: want %t", i, l.tok, l.want)
+		}
+	}
+}
+
+func TestBotAuthenticatorAuthenticate(t *testing.T) {
+	a, err := newBotAuthenticator(&config{BotAuth: []botAuth{{Secret: "s1"}, {Pool: "p", Secret: "s2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tok := a.newToken(now)
+	data := []struct {
+		auth   string
+		query  string
+		remote string
+		want   botIdentity
+		err    string
+	}{
+		{"Bearer s1", "", "10.0.0.1:1", botIdentity{name: "bot:secret", method: "secret"}, ""},
+		{"Bearer s2", "", "10.0.0.1:1", botIdentity{name: "bot:secret/p", method: "secret", pool: "p"}, ""},
+		{"Bearer " + tok, "", "10.0.0.1:1", botIdentity{name: "bot:token", method: "token"}, ""},
+		{"", "?tok=" + tok, "10.0.0.1:1", botIdentity{name: "bot:token", method: "token"}, ""},
+		{"", "", "127.0.0.1:1", botIdentity{name: "bot:localhost", method: "localhost"}, ""},
+		// A bad credential is rejected even from localhost.
+		{"Bearer s3", "", "127.0.0.1:1", botIdentity{}, "invalid bot credential"},
+		{"", "?tok=bad", "10.0.0.1:1", botIdentity{}, "invalid or expired bootstrap token"},
+		{"", "", "10.0.0.1:1", botIdentity{}, "missing bot credential"},
+	}
+	for i, l := range data {
+		r := httptest.NewRequest("POST", "/poll"+l.query, nil)
+		r.RemoteAddr = l.remote
+		if l.auth != "" {
+			r.Header.Set("Authorization", l.auth)
+		}
+		got, err := a.authenticate(r, now)
+		if l.err != "" {
+			if err == nil || err.Error() != l.err {
+				t.Errorf("#%d: %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+		} else if got != l.want {
+			t.Errorf("#%d: %+v", i, got)
+		}
+	}
+}
+
+func TestBotIdentityAllows(t *testing.T) {
+	data := []struct {
+		pool string
+		dims map[string][]string
+		want bool
+	}{
+		{"", nil, true},
+		{"", map[string][]string{"pool": {"a", "b"}}, true},
+		{"a", map[string][]string{"pool": {"a"}}, true},
+		{"a", map[string][]string{"pool": {"b"}}, false},
+		{"a", map[string][]string{"pool": {"a", "b"}}, false},
+		{"a", nil, false},
+	}
+	for i, l := range data {
+		id := botIdentity{name: "bot:secret/" + l.pool, method: "secret", pool: l.pool}
+		if got := id.allows(l.dims); got != l.want {
+			t.Errorf("#%d: want %t", i, l.want)
+		}
+	}
+}
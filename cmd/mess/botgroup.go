@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// botGroups assigns the bots to their botGroup.
+type botGroups struct {
+	groups []botGroup
+	// rev is the revision of the configuration, sent to the bots on handshake.
+	rev string
+}
+
+// newBotGroups loads the bot_config files of the groups.
+//
+// The revision covers the bot_config files content so the bots are told when
+// their configuration changed.
+func newBotGroups(groups []botGroup) (*botGroups, error) {
+	raw, err := json.Marshal(groups)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write(raw)
+	for i := range groups {
+		g := &groups[i]
+		if g.BotConfig == "" {
+			continue
+		}
+		if g.script, err = os.ReadFile(g.BotConfig); err != nil {
+			return nil, err
+		}
+		s := sha256.Sum256(g.script)
+		g.scriptRev = hex.EncodeToString(s[:])
+		h.Write(s[:])
+	}
+	return &botGroups{groups: groups, rev: hex.EncodeToString(h.Sum(nil)[:20])}, nil
+}
+
+// match returns the group of a bot.
+//
+// Returns nil if the bot is in no group. It is only allowed when no group is
+// configured.
+func (b *botGroups) match(id string) *botGroup {
+	var best *botGroup
+	l := -1
+	for i := range b.groups {
+		g := &b.groups[i]
+		for _, v := range g.BotIDs {
+			if v == id {
+				return g
+			}
+		}
+		for _, p := range g.BotIDPrefixes {
+			if len(p) > l && strings.HasPrefix(id, p) {
+				best = g
+				l = len(p)
+			}
+		}
+	}
+	return best
+}
+
+// dimensions returns the dimensions injected in the bots.
+func (g *botGroup) dimensions() map[string][]string {
+	out := map[string][]string{"pool": {g.Pool}}
+	for _, d := range g.Dimensions {
+		k, v, _ := strings.Cut(d, ":")
+		out[k] = append(out[k], v)
+	}
+	return out
+}
+
+// inject returns the dimensions reported by a bot with the server side
+// dimensions overriding them.
+func (g *botGroup) inject(dims map[string][]string) map[string][]string {
+	out := make(map[string][]string, len(dims)+len(g.Dimensions)+1)
+	for k, v := range dims {
+		out[k] = v
+	}
+	for k, v := range g.dimensions() {
+		out[k] = v
+	}
+	return out
+}
+
+// allowsAuth returns true if the bots can authenticate with this method.
+func (g *botGroup) allowsAuth(method string) bool {
+	if len(g.Auth) == 0 {
+		return true
+	}
+	for _, a := range g.Auth {
+		if a == method {
+			return true
+		}
+	}
+	return false
+}
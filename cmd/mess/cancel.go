@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+// cancel cancels a task.
+//
+// A pending task is canceled right away. A running task is only killed if
+// killRunning is set: its bot is told to stop it on its next task_update, then
+// the task ends as KILLED.
+//
+// Returns false if the task is unknown, already completed or running while
+// killRunning is not set.
+func (s *scheduler) cancel(key int64, killRunning bool, now time.Time) (ok, wasRunning bool) {
+	s.updateResult(key, func(res *model.TaskResult) bool {
+		s.mu.Lock()
+		p := s.tasks[key]
+		if p != nil {
+			s.removeLocked(p)
+		}
+		s.mu.Unlock()
+		if p != nil {
+			res.State = model.Canceled
+			res.Abandoned = now
+			res.Modified = now
+			ok = true
+			return true
+		}
+		if res.Key == 0 {
+			return false
+		}
+		switch res.State {
+		case model.Running:
+			wasRunning = true
+			if !killRunning {
+				return false
+			}
+		case model.Pending:
+			// The task is not queued but not saved as running yet either, e.g. it
+			// is being assigned to a bot right now. It is killed as soon as it
+			// starts.
+		default:
+			return false
+		}
+		ok = true
+		if res.Killing && res.PreemptedBy == 0 {
+			return false
+		}
+		// Killing a preempted task cancels its requeue.
+		res.Killing = true
+		res.PreemptedBy = 0
+		res.Modified = now
+		s.mu.Lock()
+		if rt, found := s.running[res.BotID]; found && rt.key == key {
+			// The bot will soon be free, no need to preempt another one.
+			rt.preempting = true
+			s.running[res.BotID] = rt
+		}
+		s.mu.Unlock()
+		return true
+	})
+	return ok, wasRunning
+}
+
+// cancelTasks cancels the tasks that have all the tags and were created
+// before end, if set, like cancel.
+//
+// The tasks are processed in key order, up to limit at a time. Returns the
+// number of tasks canceled and the cursor to process the next ones, if any.
+func (s *scheduler) cancelTasks(tags []string, end time.Time, killRunning bool, cursor string, limit int, now time.Time) (int, string, error) {
+	after := int64(0)
+	if cursor != "" {
+		if after = model.FromTaskID(model.TaskID(cursor)); after == 0 {
+			return 0, "", errors.New("invalid cursor")
+		}
+	}
+	match := func(r *model.TaskRequest) bool {
+		if !end.IsZero() && !r.Created.Before(end) {
+			return false
+		}
+		for _, t := range tags {
+			found := false
+			for _, v := range r.Tags {
+				if v == t {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+
+	var keys, running []int64
+	s.mu.Lock()
+	for key, p := range s.tasks {
+		if key > after && match(p.r) {
+			keys = append(keys, key)
+		}
+	}
+	if killRunning {
+		for _, rt := range s.running {
+			if rt.key > after {
+				running = append(running, rt.key)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, key := range running {
+		r := model.TaskRequest{}
+		if s.tables.TaskRequestGet(key, &r); match(&r) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	next := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = string(model.ToTaskID(keys[limit-1]))
+	}
+	n := 0
+	for _, key := range keys {
+		if ok, _ := s.cancel(key, killRunning, now); ok {
+			n++
+		}
+	}
+	return n, next, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+func TestCancel(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		running    bool
+		kill       bool
+		ok         bool
+		wasRunning bool
+		state      model.TaskState
+	}{
+		{false, false, true, false, model.Canceled},
+		{false, true, true, false, model.Canceled},
+		{true, false, false, true, model.Running},
+		{true, true, true, true, model.Running},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		var res *model.TaskResult
+		if l.running {
+			res = startTestTask(t, s, bot, testRequest(100, linux))
+		} else {
+			busyBot(t, s, bot)
+			res = newTestTask(t, s, testRequest(100, linux))
+		}
+		if ok, wasRunning := s.sched.cancel(res.Key, l.kill, testNow); ok != l.ok || wasRunning != l.wasRunning {
+			t.Fatalf("#%d: %t %t", i, ok, wasRunning)
+		}
+		got := getResult(s, res.Key)
+		if got.State != l.state || got.Killing != (l.running && l.kill) {
+			t.Errorf("#%d: %+v", i, got)
+		}
+		// A canceled task is not runnable anymore.
+		if p, _ := s.sched.pollNow(bot, testNow); p != nil {
+			t.Errorf("#%d: %d", i, p.r.Key)
+		}
+		// It can't be canceled twice.
+		if ok, _ := s.sched.cancel(res.Key, l.kill, testNow); ok {
+			t.Errorf("#%d: canceled twice", i)
+		}
+	}
+	// Unknown task.
+	s := newTestServer(t)
+	if ok, _ := s.sched.cancel(42, true, testNow); ok {
+		t.Fatal("canceled")
+	}
+}
+
+func TestCancelTasks(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	newTask := func(tags ...string) *model.TaskResult {
+		r := testRequest(100, linux)
+		r.Tags = tags
+		return newTestTask(t, s, r)
+	}
+	running := startTestTask(t, s, bot, testRequest(100, linux))
+	a := []*model.TaskResult{newTask("a:1"), newTask("a:1", "b:1"), newTask("a:1")}
+	b := newTask("b:1")
+	// Only the pending tasks, two at a time.
+	n, cursor, err := s.sched.cancelTasks([]string{"a:1"}, time.Time{}, false, "", 2, testNow)
+	if err != nil || n != 2 || cursor != string(model.ToTaskID(a[1].Key)) {
+		t.Fatalf("%v %d %q", err, n, cursor)
+	}
+	if n, cursor, err = s.sched.cancelTasks([]string{"a:1"}, time.Time{}, false, cursor, 2, testNow); err != nil || n != 1 || cursor != "" {
+		t.Fatalf("%v %d %q", err, n, cursor)
+	}
+	for i, res := range a {
+		if got := getResult(s, res.Key); got.State != model.Canceled {
+			t.Errorf("#%d: %d", i, got.State)
+		}
+	}
+	if got := getResult(s, b.Key); got.State != model.Pending {
+		t.Fatal(got.State)
+	}
+	if _, _, err = s.sched.cancelTasks([]string{"a:1"}, time.Time{}, false, "bad", 2, testNow); err == nil {
+		t.Fatal("expected error")
+	}
+	// Kill the running task too. Only the tasks created before end match.
+	if n, _, err = s.sched.cancelTasks(nil, testNow, true, "", 10, testNow); err != nil || n != 0 {
+		t.Fatalf("%v %d", err, n)
+	}
+	if n, _, err = s.sched.cancelTasks(nil, testNow.Add(time.Second), true, "", 10, testNow); err != nil || n != 2 {
+		t.Fatalf("%v %d", err, n)
+	}
+	if got := getResult(s, running.Key); got.State != model.Running || !got.Killing {
+		t.Fatalf("%+v", got)
+	}
+	if got := getResult(s, b.Key); got.State != model.Canceled {
+		t.Fatal(got.State)
+	}
+}
+
+func TestCancelWhileStarting(t *testing.T) {
+	s := newTestServer(t)
+	s.sched.tables = slowTables{s.sched.tables}
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	// stopWaiting unregisters the bot as if its poll timed out, so the next
+	// task stays pending.
+	stopWaiting := func(w *waitingBot) {
+		if w != nil {
+			s.sched.mu.Lock()
+			s.sched.removeWaitingLocked(w)
+			s.sched.mu.Unlock()
+		}
+	}
+	_, w := s.sched.pollNow(bot, testNow)
+	stopWaiting(w)
+	for i := 0; i < 50; i++ {
+		res := newTestTask(t, s, testRequest(100, linux))
+		if res.State != model.Pending {
+			t.Fatalf("#%d: %d", i, res.State)
+		}
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, w := s.sched.pollNow(bot, testNow)
+			stopWaiting(w)
+		}()
+		go func() {
+			defer wg.Done()
+			// Vary when the cancelation happens while the task is assigned.
+			time.Sleep(time.Duration(i%8) * 500 * time.Microsecond)
+			if ok, _ := s.sched.cancel(res.Key, true, testNow); !ok {
+				t.Errorf("#%d: cancel failed", i)
+			}
+		}()
+		wg.Wait()
+		// Either the task was canceled while pending, or the bot got it and
+		// must kill it. It is never left pending out of its queue.
+		switch got := getResult(s, res.Key); got.State {
+		case model.Canceled:
+		case model.Running:
+			if !got.Killing || got.BotID != bot.Key {
+				t.Fatalf("#%d: %+v", i, got)
+			}
+			// The bot polls again, so it lost the task.
+			_, w := s.sched.pollNow(bot, testNow)
+			stopWaiting(w)
+			if got = getResult(s, res.Key); got.State != model.Killed {
+				t.Fatalf("#%d: %d", i, got.State)
+			}
+		default:
+			t.Fatalf("#%d: %d", i, got.State)
+		}
+	}
+}
+
+// slowTables widens the window between reading and saving a TaskResult, to
+// surface the lost updates.
+type slowTables struct {
+	model.Tables
+}
+
+func (s slowTables) TaskResultSet(r *model.TaskResult) {
+	time.Sleep(2 * time.Millisecond)
+	s.Tables.TaskResultSet(r)
+}
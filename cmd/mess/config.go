@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// config is the server configuration, loaded from the file passed to -config.
+type config struct {
+	// Quotas limit the number of pending and running tasks per tag or user.
+	Quotas []quota `json:"quotas"`
+	// BotAuth lists the credentials accepted from bots, in addition to
+	// bootstrap tokens and connections from localhost. See botauth.go.
+	BotAuth []botAuth `json:"bot_auth"`
+	// TokenKey is the HMAC key to sign the bootstrap tokens issued by
+	// /server/token. When empty, a random key is used and the tokens are
+	// invalidated on restart.
+	TokenKey string `json:"token_key"`
+	// Bootstrappers are the users allowed to get bootstrap tokens from
+	// /server/token. With -local, anyone on localhost is also allowed.
+	Bootstrappers []string `json:"bootstrappers"`
+	// TLSCert and TLSKey are the PEM files to serve HTTPS directly instead of
+	// being fronted by a reverse proxy. Required for client certificates.
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// ClientCA is the PEM file of the certificate authorities signing the bots
+	// client certificates.
+	ClientCA string `json:"client_ca"`
+	// BotConfig is the path to a bot_config.py file replacing the default one
+	// in swarming_bot.zip.
+	BotConfig string `json:"bot_config"`
+	// BotGroups assign the bots to pools. When set, bots not in a group are
+	// rejected. See botgroup.go.
+	BotGroups []botGroup `json:"bot_groups"`
+}
+
+// botAuth is a credential a bot can authenticate with.
+type botAuth struct {
+	// Pool is the only value of the "pool" dimension the bots using this
+	// credential can have. Empty means any pool.
+	Pool string `json:"pool"`
+	// Secret is a shared secret sent as "Authorization: Bearer <secret>".
+	// Mutually exclusive with CommonName.
+	Secret string `json:"secret"`
+	// CommonName is the subject common name of a client certificate signed by
+	// ClientCA. Mutually exclusive with Secret.
+	CommonName string `json:"common_name"`
+}
+
+// quota limits the tasks with a tag or from a user in a pool.
+type quota struct {
+	// Pool is the value of the "pool" dimension the quota applies to. Empty
+	// means all pools.
+	Pool string `json:"pool"`
+	// Tag is a "key:value" task tag. Mutually exclusive with User.
+	Tag string `json:"tag"`
+	// User is the user that created the tasks. Mutually exclusive with Tag.
+	User string `json:"user"`
+	// MaxPending is the maximum number of pending tasks. 0 means unlimited.
+	MaxPending int `json:"max_pending"`
+	// MaxRunning is the maximum number of running tasks. 0 means unlimited.
+	MaxRunning int `json:"max_running"`
+}
+
+func (q *quota) validate() error {
+	if (q.Tag == "") == (q.User == "") {
+		return errors.New("exactly one of tag or user must be set")
+	}
+	if q.Tag != "" && !strings.Contains(q.Tag, ":") {
+		return fmt.Errorf("tag %q must be in the form key:value", q.Tag)
+	}
+	if q.MaxPending < 0 || q.MaxRunning < 0 {
+		return errors.New("limits must be positive")
+	}
+	if q.MaxPending == 0 && q.MaxRunning == 0 {
+		return errors.New("at least one of max_pending or max_running must be set")
+	}
+	return nil
+}
+
+// String returns the quota subject, e.g. `tag project:foo in pool "bar"`.
+func (q *quota) String() string {
+	s := "user " + q.User
+	if q.Tag != "" {
+		s = "tag " + q.Tag
+	}
+	if q.Pool != "" {
+		s += fmt.Sprintf(" in pool %q", q.Pool)
+	}
+	return s
+}
+
+// botGroup is a group of bots sharing the same server side configuration.
+type botGroup struct {
+	// BotIDs are the IDs of the bots in this group.
+	BotIDs []string `json:"bot_ids"`
+	// BotIDPrefixes are the prefixes of the IDs of the bots in this group. An
+	// exact match in BotIDs takes precedence, then the longest prefix.
+	BotIDPrefixes []string `json:"bot_id_prefixes"`
+	// Pool is the only pool the bots are in. It overrides the "pool" dimension
+	// the bots report.
+	Pool string `json:"pool"`
+	// Dimensions are "key:value" dimensions injected in the bots dimensions,
+	// overriding the values the bots report for these keys.
+	Dimensions []string `json:"dimensions"`
+	// Owners are the people responsible for the bots, e.g. to contact them when
+	// a bot misbehaves.
+	Owners []string `json:"owners"`
+	// Auth are the authentication methods the bots can use: "localhost",
+	// "secret" or "cert". Empty means any. Bootstrap tokens can only download
+	// the bot code.
+	Auth []string `json:"auth"`
+	// BotConfig is the path to a python file sent to the bots on handshake. Its
+	// hooks take precedence over the ones in bot_config.py.
+	BotConfig string `json:"bot_config"`
+
+	// Loaded by newBotGroups.
+	script    []byte
+	scriptRev string
+}
+
+func (g *botGroup) validate() error {
+	if len(g.BotIDs) == 0 && len(g.BotIDPrefixes) == 0 {
+		return errors.New("at least one of bot_ids or bot_id_prefixes must be set")
+	}
+	if g.Pool == "" {
+		return errors.New("pool must be set")
+	}
+	for _, d := range g.Dimensions {
+		k, _, ok := strings.Cut(d, ":")
+		if !ok || k == "" {
+			return fmt.Errorf("dimension %q must be in the form key:value", d)
+		}
+		if k == "pool" || k == "id" {
+			return fmt.Errorf("dimension %q cannot be injected", k)
+		}
+	}
+	for _, a := range g.Auth {
+		switch a {
+		case "localhost", "secret", "cert":
+		default:
+			return fmt.Errorf("unknown auth %q", a)
+		}
+	}
+	return nil
+}
+
+func (c *config) validate() error {
+	for i := range c.Quotas {
+		if err := c.Quotas[i].validate(); err != nil {
+			return fmt.Errorf("quota #%d: %w", i, err)
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		return errors.New("client_ca requires tls_cert")
+	}
+	for i := range c.BotAuth {
+		b := &c.BotAuth[i]
+		if (b.Secret == "") == (b.CommonName == "") {
+			return fmt.Errorf("bot_auth #%d: exactly one of secret or common_name must be set", i)
+		}
+		if b.CommonName != "" && c.ClientCA == "" {
+			return fmt.Errorf("bot_auth #%d: common_name requires client_ca", i)
+		}
+	}
+	ids := map[string]struct{}{}
+	prefixes := map[string]struct{}{}
+	dupe := func(m map[string]struct{}, l []string) string {
+		for _, v := range l {
+			if _, ok := m[v]; ok {
+				return v
+			}
+			m[v] = struct{}{}
+		}
+		return ""
+	}
+	for i := range c.BotGroups {
+		g := &c.BotGroups[i]
+		if err := g.validate(); err != nil {
+			return fmt.Errorf("bot_groups #%d: %w", i, err)
+		}
+		if d := dupe(ids, g.BotIDs); d != "" {
+			return fmt.Errorf("bot_groups #%d: bot %q is in multiple groups", i, d)
+		}
+		if d := dupe(prefixes, g.BotIDPrefixes); d != "" {
+			return fmt.Errorf("bot_groups #%d: prefix %q is in multiple groups", i, d)
+		}
+	}
+	return nil
+}
+
+// loadConfig loads the server configuration. An empty path returns the
+// default configuration.
+func loadConfig(path string) (*config, error) {
+	c := &config{}
+	if path == "" {
+		return c, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err = d.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
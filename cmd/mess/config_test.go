@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestConfigValidate(t *testing.T) {
+	good := config{
+		Quotas:    []quota{{Pool: "p", Tag: "project:foo", MaxPending: 10}, {User: "joe", MaxRunning: 1}},
+		BotAuth:   []botAuth{{Secret: "s"}, {Pool: "p", CommonName: "bot"}},
+		TLSCert:   "cert.pem",
+		TLSKey:    "key.pem",
+		ClientCA:  "ca.pem",
+		BotGroups: []botGroup{{BotIDPrefixes: []string{"bot"}, Pool: "p", Dimensions: []string{"os:Linux"}, Auth: []string{"secret", "cert"}}},
+	}
+	if err := good.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&config{}).validate(); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		c   config
+		err string
+	}{
+		{config{Quotas: []quota{{MaxPending: 1}}}, "quota #0: exactly one of tag or user must be set"},
+		{config{Quotas: []quota{{Tag: "a:b", User: "joe", MaxPending: 1}}}, "quota #0: exactly one of tag or user must be set"},
+		{config{Quotas: []quota{{Tag: "a", MaxPending: 1}}}, "quota #0: tag \"a\" must be in the form key:value"},
+		{config{Quotas: []quota{{User: "joe", MaxPending: -1}}}, "quota #0: limits must be positive"},
+		{config{Quotas: []quota{{User: "joe"}}}, "quota #0: at least one of max_pending or max_running must be set"},
+		{config{TLSCert: "cert.pem"}, "tls_cert and tls_key must be set together"},
+		{config{TLSKey: "key.pem"}, "tls_cert and tls_key must be set together"},
+		{config{ClientCA: "ca.pem"}, "client_ca requires tls_cert"},
+		{config{BotAuth: []botAuth{{Pool: "p"}}}, "bot_auth #0: exactly one of secret or common_name must be set"},
+		{config{BotAuth: []botAuth{{Secret: "s", CommonName: "bot"}}}, "bot_auth #0: exactly one of secret or common_name must be set"},
+		{config{BotAuth: []botAuth{{CommonName: "bot"}}}, "bot_auth #0: common_name requires client_ca"},
+		{config{BotGroups: []botGroup{{Pool: "p"}}}, "bot_groups #0: at least one of bot_ids or bot_id_prefixes must be set"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}}}}, "bot_groups #0: pool must be set"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p", Dimensions: []string{"os"}}}}, "bot_groups #0: dimension \"os\" must be in the form key:value"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p", Dimensions: []string{":Linux"}}}}, "bot_groups #0: dimension \":Linux\" must be in the form key:value"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p", Dimensions: []string{"pool:q"}}}}, "bot_groups #0: dimension \"pool\" cannot be injected"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p", Dimensions: []string{"id:b"}}}}, "bot_groups #0: dimension \"id\" cannot be injected"},
+		{config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p", Auth: []string{"token"}}}}, "bot_groups #0: unknown auth \"token\""},
+		{
+			config{BotGroups: []botGroup{{BotIDs: []string{"a"}, Pool: "p"}, {BotIDs: []string{"b", "a"}, Pool: "q"}}},
+			"bot_groups #1: bot \"a\" is in multiple groups",
+		},
+		{
+			config{BotGroups: []botGroup{{BotIDPrefixes: []string{"a"}, Pool: "p"}, {BotIDPrefixes: []string{"a"}, Pool: "q"}}},
+			"bot_groups #1: prefix \"a\" is in multiple groups",
+		},
+	}
+	for i, l := range data {
+		if err := l.c.validate(); err == nil || err.Error() != l.err {
+			t.Errorf("#%d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron is a parsed cron expression. All times are in UTC.
+//
+// It supports the 5 standard fields "minute hour day-of-month month
+// day-of-week", each being "*" or a comma separated list of values, ranges
+// "a-b" and steps "*/n" or "a-b/n". It also supports the @hourly, @daily,
+// @midnight, @weekly, @monthly, @yearly, @annually shorthands and "@every
+// <duration>".
+type cron struct {
+	every time.Duration
+	// Bitsets of the matching values for each field.
+	minute, hour, dom, month, dow uint64
+	// domAll and dowAll are set when the field is "*". When both day fields are
+	// restricted, a day matching either of them matches, like Vixie cron.
+	domAll, dowAll bool
+}
+
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// parseCron parses a cron expression.
+func parseCron(s string) (*cron, error) {
+	if d, ok := strings.CutPrefix(s, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, err
+		}
+		if every < time.Minute {
+			return nil, errors.New("@every must be at least 1m")
+		}
+		return &cron{every: every}, nil
+	}
+	if v, ok := cronShorthands[s]; ok {
+		s = v
+	}
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: expected 5 fields", s)
+	}
+	c := &cron{}
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid cron minute: %w", err)
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid cron hour: %w", err)
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid cron day of month: %w", err)
+	}
+	if c.month, err = parseCronField(f[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid cron month: %w", err)
+	}
+	// 7 is also Sunday.
+	if c.dow, err = parseCronField(f[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid cron day of week: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAll = f[2] == "*"
+	c.dowAll = f[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression as a bitset.
+func parseCronField(s string, min, max int) (uint64, error) {
+	var out uint64
+	for _, part := range strings.Split(s, ",") {
+		r, step, hasStep := strings.Cut(part, "/")
+		lo, hi := min, max
+		if r != "*" {
+			a, b, isRange := strings.Cut(r, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("%q: %w", part, err)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("%q: %w", part, err)
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q: out of range [%d, %d]", part, min, max)
+			}
+		}
+		n := 1
+		if hasStep {
+			var err error
+			if n, err = strconv.Atoi(step); err != nil || n <= 0 {
+				return 0, fmt.Errorf("%q: invalid step", part)
+			}
+		}
+		for i := lo; i <= hi; i += n {
+			out |= 1 << uint(i)
+		}
+	}
+	return out, nil
+}
+
+// next returns the first time strictly after t that matches. Returns the zero
+// time if there is none in the next 5 years, e.g. "0 0 30 2 *".
+func (c *cron) next(t time.Time) time.Time {
+	t = t.UTC()
+	if c.every != 0 {
+		return t.Add(c.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAll || c.dowAll {
+		return dom && dow
+	}
+	return dom || dow
+}
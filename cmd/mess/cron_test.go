@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Thursday.
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data := []struct {
+		cron string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 2, 3, 5, 0, 0, time.UTC)},
+		{"5,10 3 * * *", time.Date(2020, 1, 2, 3, 5, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 2, 3, 15, 0, 0, time.UTC)},
+		{"30 9-17/2 * * 1-5", time.Date(2020, 1, 2, 9, 30, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2020, 1, 2, 4, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@midnight", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@annually", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2020, 1, 2, 4, 34, 5, 0, time.UTC)},
+		// 7 is also Sunday.
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		// Both day fields are restricted: either matches.
+		{"0 0 13 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for i, l := range data {
+		c, err := parseCron(l.cron)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if got := c.next(now); !got.Equal(l.want) {
+			t.Errorf("#%d: %q: want %s, got %s", i, l.cron, l.want, got)
+		}
+	}
+}
+
+func TestParseCronError(t *testing.T) {
+	data := []struct {
+		cron string
+		err  string
+	}{
+		{"", "invalid cron \"\": expected 5 fields"},
+		{"* * * *", "invalid cron \"* * * *\": expected 5 fields"},
+		{"60 * * * *", "invalid cron minute: \"60\": out of range [0, 59]"},
+		{"5-1 * * * *", "invalid cron minute: \"5-1\": out of range [0, 59]"},
+		{"*/0 * * * *", "invalid cron minute: \"*/0\": invalid step"},
+		{"a * * * *", "invalid cron minute: \"a\": strconv.Atoi: parsing \"a\": invalid syntax"},
+		{"* 24 * * *", "invalid cron hour: \"24\": out of range [0, 23]"},
+		{"* * 0 * *", "invalid cron day of month: \"0\": out of range [1, 31]"},
+		{"* * * 13 *", "invalid cron month: \"13\": out of range [1, 12]"},
+		{"* * * * 8", "invalid cron day of week: \"8\": out of range [0, 7]"},
+		{"@every 30s", "@every must be at least 1m"},
+		{"@every x", "time: invalid duration \"x\""},
+	}
+	for i, l := range data {
+		if _, err := parseCron(l.cron); err == nil || err.Error() != l.err {
+			t.Errorf("#%d: %v", i, err)
+		}
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/maruel/mess/internal"
 	"github.com/maruel/mess/internal/model"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -106,9 +107,62 @@ func mainImpl() error {
 	local := flag.Bool("local", false, "Bind local, allow everyone to be admin; useful for local testing the UI")
 	cid := flag.String("cid", "", "Google OAuth2 Client ID")
 	usr := flag.String("usr", "", "Comma separated users allowed access")
+	fairShare := flag.String("fair-share", "", "Balance the tasks within a priority band between each \"user\" or \"realm\"")
+	fairShareWeights := flag.String("fair-share-weights", "", "Comma separated name=weight of users or realms for -fair-share; default weight is 1")
+	cfgPath := flag.String("config", "", "Server configuration file, see config.go")
+	simPath := flag.String("simulate", "", "Replay a workload file with the scheduler and print statistics instead of running the server, see simulate.go")
+	recordPath := flag.String("record-workload", "", "Save the tasks and bots in the DB as a workload file for -simulate and exit")
 
 	flag.Parse()
 
+	if *fairShare != "" && *fairShare != "user" && *fairShare != "realm" {
+		return fmt.Errorf("invalid -fair-share %q", *fairShare)
+	}
+	weights := map[string]float64{}
+	if *fairShareWeights != "" {
+		for _, v := range strings.Split(*fairShareWeights, ",") {
+			name, weight, _ := strings.Cut(v, "=")
+			f, err := strconv.ParseFloat(weight, 64)
+			if err != nil || f <= 0 {
+				return fmt.Errorf("invalid -fair-share-weights %q", v)
+			}
+			weights[name] = f
+		}
+	}
+
+	cfg, err := loadConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+
+	if *simPath != "" {
+		wl, err := loadWorkload(*simPath)
+		if err != nil {
+			return err
+		}
+		return simulate(wl, *fairShare, weights, cfg.Quotas, os.Stdout)
+	}
+
+	botAuth, err := newBotAuthenticator(cfg)
+	if err != nil {
+		return err
+	}
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	groups, err := newBotGroups(cfg.BotGroups)
+	if err != nil {
+		return err
+	}
+	if cfg.BotConfig != "" {
+		raw, err := os.ReadFile(cfg.BotConfig)
+		if err != nil {
+			return err
+		}
+		internal.SetBotConfig(raw)
+	}
+
 	if *cid == "" {
 		fmt.Printf("Warning: you should pass -cid\n")
 		fmt.Printf("\n")
@@ -136,6 +190,11 @@ func mainImpl() error {
 		fmt.Printf("\n")
 	}
 
+	bootstrappers := map[string]struct{}{}
+	for _, u := range cfg.Bootstrappers {
+		bootstrappers[u] = struct{}{}
+	}
+
 	outputs, err := model.NewTaskOutputs("outputs")
 	if err != nil {
 		return err
@@ -146,6 +205,13 @@ func mainImpl() error {
 	if err != nil {
 		return err
 	}
+	if *recordPath != "" {
+		err = saveWorkload(*recordPath, recordWorkload(d))
+		if err2 := d.Close(); err == nil {
+			err = err2
+		}
+		return err
+	}
 
 	ctx, cancel, err := watchExe(context.Background())
 	if err != nil {
@@ -163,14 +229,25 @@ func mainImpl() error {
 	wg := sync.WaitGroup{}
 	ver := getVersion()
 	s := server{
-		local:     *local,
-		version:   ver,
-		cid:       *cid,
-		allowed:   allowed,
-		tables:    d,
-		outputs:   outputs,
-		authCache: map[string]*userInfo{},
+		local:         *local,
+		version:       ver,
+		cid:           *cid,
+		allowed:       allowed,
+		bootstrappers: bootstrappers,
+		botAuth:       botAuth,
+		tls:           tlsCfg,
+		groups:        groups,
+		tables:        d,
+		outputs:       outputs,
+		authCache:     map[string]*userInfo{},
+	}
+	s.sched.fairShare = *fairShare
+	s.sched.weights = weights
+	for i := range cfg.Quotas {
+		s.sched.quotas = append(s.sched.quotas, &quotaState{quota: cfg.Quotas[i]})
 	}
+	s.sched.outputs = outputs
+	s.sched.newTask = s.newTask
 	s.sched.init(d)
 	wg.Add(1)
 	go func() {
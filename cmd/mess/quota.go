@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+// errQuota is returned when a task is rejected because of a quota.
+var errQuota = errors.New("quota exceeded")
+
+// quotaState is a quota and the tasks currently counted against it.
+//
+// The counts are protected by scheduler.mu.
+type quotaState struct {
+	quota
+	// reserved is the number of tasks admitted but not enqueued yet.
+	reserved int
+	pending  int
+	running  int
+}
+
+// matches returns true if the quota applies to a task.
+//
+// A task is in a pool if any of its slices requests it.
+func (q *quotaState) matches(r *model.TaskRequest) bool {
+	if q.User != "" && q.User != r.User {
+		return false
+	}
+	if q.Tag != "" {
+		found := false
+		for _, t := range r.Tags {
+			if t == q.Tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Pool == "" {
+		return true
+	}
+	for i := range r.TaskSlices {
+		for _, v := range r.TaskSlices[i].Properties.Dimensions["pool"] {
+			for _, alt := range strings.Split(v, "|") {
+				if alt == q.Pool {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// quotasOf returns the quotas that apply to a task.
+func (s *scheduler) quotasOf(r *model.TaskRequest) []*quotaState {
+	var out []*quotaState
+	for _, q := range s.quotas {
+		if q.matches(r) {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// admit reserves a pending task in the quotas of a new task, or returns an
+// error if one of them is exhausted.
+//
+// The reservation is consumed by enqueue. If the task is not enqueued, e.g. it
+// was deduplicated, release must be called instead.
+func (s *scheduler) admit(r *model.TaskRequest) error {
+	qs := s.quotasOf(r)
+	if len(qs) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range qs {
+		if q.MaxPending != 0 && q.pending+q.reserved >= q.MaxPending {
+			return fmt.Errorf("%w: %s is limited to %d pending tasks", errQuota, &q.quota, q.MaxPending)
+		}
+	}
+	for _, q := range qs {
+		q.reserved++
+	}
+	return nil
+}
+
+// release releases the reservation made by admit.
+func (s *scheduler) release(r *model.TaskRequest) {
+	s.mu.Lock()
+	s.releaseLocked(r)
+	s.mu.Unlock()
+}
+
+func (s *scheduler) releaseLocked(r *model.TaskRequest) {
+	for _, q := range s.quotasOf(r) {
+		q.reserved--
+	}
+}
+
+// runnableLocked returns false if a task must stay pending because one of its
+// quotas reached its maximum number of running tasks.
+func (s *scheduler) runnableLocked(r *model.TaskRequest) bool {
+	for _, q := range s.quotas {
+		if q.MaxRunning != 0 && q.running >= q.MaxRunning && q.matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// addPendingLocked updates the pending count of the quotas of a task.
+func (s *scheduler) addPendingLocked(r *model.TaskRequest, delta int) {
+	for _, q := range s.quotas {
+		if q.matches(r) {
+			q.pending += delta
+		}
+	}
+}
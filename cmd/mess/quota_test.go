@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+func TestQuotaMatches(t *testing.T) {
+	r := &model.TaskRequest{
+		User: "joe",
+		Tags: []string{"project:a", "os:Linux"},
+		TaskSlices: []model.TaskSlice{
+			{Properties: model.TaskProperties{Dimensions: map[string][]string{"pool": {"p1"}}}},
+			{Properties: model.TaskProperties{Dimensions: map[string][]string{"pool": {"p2|p3"}}}},
+		},
+	}
+	data := []struct {
+		q    quota
+		want bool
+	}{
+		{quota{User: "joe"}, true},
+		{quota{User: "jane"}, false},
+		{quota{Tag: "project:a"}, true},
+		{quota{Tag: "project:b"}, false},
+		{quota{Tag: "project:a", Pool: "p1"}, true},
+		// Any slice and any OR alternative puts the task in the pool.
+		{quota{Tag: "project:a", Pool: "p3"}, true},
+		{quota{User: "joe", Pool: "p4"}, false},
+	}
+	for i, l := range data {
+		q := quotaState{quota: l.q}
+		if got := q.matches(r); got != l.want {
+			t.Errorf("#%d: %s: want %t", i, &q.quota, l.want)
+		}
+	}
+}
+
+func TestAdmitRelease(t *testing.T) {
+	s := newTestScheduler(t)
+	s.quotas = []*quotaState{
+		{quota: quota{Tag: "project:a", MaxPending: 2}},
+		{quota: quota{User: "joe", MaxPending: 1}},
+	}
+	joe := &model.TaskRequest{User: "joe", Tags: []string{"project:a"}}
+	jane := &model.TaskRequest{User: "jane", Tags: []string{"project:a"}}
+	other := &model.TaskRequest{User: "jane", Tags: []string{"project:b"}}
+	data := []struct {
+		r       *model.TaskRequest
+		release bool
+		err     string
+	}{
+		{joe, false, ""},
+		{joe, false, "quota exceeded: user joe is limited to 1 pending tasks"},
+		{jane, false, ""},
+		{jane, false, "quota exceeded: tag project:a is limited to 2 pending tasks"},
+		// Not limited.
+		{other, false, ""},
+		{other, false, ""},
+		{jane, true, ""},
+		{jane, false, ""},
+		{joe, true, ""},
+		{jane, false, ""},
+		{joe, false, "quota exceeded: tag project:a is limited to 2 pending tasks"},
+	}
+	for i, l := range data {
+		if l.release {
+			s.release(l.r)
+			continue
+		}
+		err := s.admit(l.r)
+		if l.err == "" {
+			if err != nil {
+				t.Fatalf("#%d: %v", i, err)
+			}
+		} else if err == nil || err.Error() != l.err || !errors.Is(err, errQuota) {
+			t.Fatalf("#%d: %v", i, err)
+		}
+	}
+	if s.quotas[0].reserved != 2 || s.quotas[1].reserved != 0 {
+		t.Fatal(s.quotas[0].reserved, s.quotas[1].reserved)
+	}
+}
+
+func TestRunnableLocked(t *testing.T) {
+	s := newTestScheduler(t)
+	s.quotas = []*quotaState{{quota: quota{User: "joe", MaxRunning: 1}}}
+	joe := &model.TaskRequest{User: "joe"}
+	jane := &model.TaskRequest{User: "jane"}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.runnableLocked(joe) || !s.runnableLocked(jane) {
+		t.Fatal("expected runnable")
+	}
+	s.quotas[0].running = 1
+	if s.runnableLocked(joe) || !s.runnableLocked(jane) {
+		t.Fatal("expected joe to be blocked")
+	}
+}
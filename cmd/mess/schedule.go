@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+	"github.com/maruel/mess/messapi"
+	"github.com/rs/zerolog/log"
+)
+
+var reScheduleName = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,64}$`)
+
+// errScheduleExists is returned when creating a schedule with a name already
+// in use.
+var errScheduleExists = errors.New("schedule already exists")
+
+// newSchedule validates and saves a new schedule.
+func (s *scheduler) newSchedule(req *messapi.SchedulesNewRequest, now time.Time) (*model.Schedule, error) {
+	if !reScheduleName.MatchString(req.Name) {
+		return nil, fmt.Errorf("invalid schedule name %q", req.Name)
+	}
+	raw, err := json.Marshal(&req.Request)
+	if err != nil {
+		return nil, err
+	}
+	sch := &model.Schedule{
+		Key:           req.Name,
+		SchemaVersion: 1,
+		Created:       now,
+		User:          req.Request.User,
+		Cron:          req.Cron,
+		Request:       raw,
+	}
+	// Make sure the task would be valid.
+	m, err := scheduleTask(sch, now)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.ValidateAndSetDefaults(); err != nil {
+		return nil, err
+	}
+	switch {
+	case req.Cron != "" && req.At != 0:
+		return nil, errors.New("only one of cron or at can be set")
+	case req.Cron != "":
+		c, err := parseCron(req.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if sch.Next = c.next(now); sch.Next.IsZero() {
+			return nil, fmt.Errorf("cron %q never triggers", req.Cron)
+		}
+	case req.At != 0:
+		sec, frac := math.Modf(req.At)
+		sch.Next = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	default:
+		return nil, errors.New("one of cron or at must be set")
+	}
+
+	s.schedulesMu.Lock()
+	defer s.schedulesMu.Unlock()
+	old := model.Schedule{}
+	if s.tables.ScheduleGet(sch.Key, &old); old.Key != "" {
+		return nil, errScheduleExists
+	}
+	s.tables.ScheduleSet(sch)
+	return sch, nil
+}
+
+// deleteSchedule deletes a schedule. Returns false if it didn't exist.
+func (s *scheduler) deleteSchedule(name string) bool {
+	s.schedulesMu.Lock()
+	defer s.schedulesMu.Unlock()
+	return s.tables.ScheduleDelete(name)
+}
+
+// runSchedules creates the tasks of the schedules that are due.
+//
+// A recurring schedule is triggered only once even if it missed multiple
+// occurrences, e.g. the server was down. A deferred schedule is kept once
+// triggered, so its last task can be looked up, until it is deleted.
+func (s *scheduler) runSchedules(ctx context.Context, now time.Time) {
+	if s.newTask == nil {
+		return
+	}
+	for cursor := ""; ; {
+		var l []model.Schedule
+		l, cursor = s.tables.ScheduleGetSlice(cursor, 1000)
+		for i := range l {
+			if l[i].Next.IsZero() || l[i].Next.After(now) {
+				continue
+			}
+			s.schedulesMu.Lock()
+			// Reload, in case it was deleted concurrently.
+			sch := model.Schedule{}
+			if s.tables.ScheduleGet(l[i].Key, &sch); sch.Key != "" && !sch.Next.IsZero() && !sch.Next.After(now) {
+				s.runSchedule(ctx, &sch, now)
+			}
+			s.schedulesMu.Unlock()
+		}
+		if cursor == "" {
+			return
+		}
+	}
+}
+
+func (s *scheduler) runSchedule(ctx context.Context, sch *model.Schedule, now time.Time) {
+	m, err := scheduleTask(sch, now)
+	if err == nil {
+		_, err = s.newTask(ctx, m, now)
+	}
+	sch.Last = now
+	sch.LastTask = 0
+	sch.LastError = ""
+	if err != nil {
+		log.Warn().Err(err).Str("schedule", sch.Key).Msg("schedule")
+		sch.LastError = err.Error()
+	} else {
+		sch.LastTask = m.Key
+	}
+	sch.Next = time.Time{}
+	if sch.Cron != "" {
+		if c, err := parseCron(sch.Cron); err == nil {
+			sch.Next = c.next(now)
+		}
+	}
+	s.tables.ScheduleSet(sch)
+}
+
+// scheduleTask returns the task request to create for a schedule.
+func scheduleTask(sch *model.Schedule, now time.Time) (*model.TaskRequest, error) {
+	req := messapi.TasksNewRequest{}
+	if err := json.Unmarshal(sch.Request, &req); err != nil {
+		return nil, err
+	}
+	req.Tags = append(req.Tags, "schedule:"+sch.Key)
+	m := &model.TaskRequest{SchemaVersion: 1}
+	if err := req.ToDB(now, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
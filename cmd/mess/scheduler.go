@@ -1,103 +1,1598 @@
 package main
 
 import (
+	"container/heap"
 	"context"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/maruel/mess/internal/model"
+	"github.com/maruel/mess/messapi"
 )
 
 type scheduler struct {
-	mu     sync.Mutex
-	bots   map[string]*waitingBot
-	queues map[uint64][]taskQueue
+	tables model.Tables
+	// outputs are the task outputs, truncated when a task is requeued. It is
+	// not set in the simulator.
+	outputs *model.TaskOutputs
+	// fairShare is the TaskRequest field used to balance the tasks within a
+	// priority band: "user", "realm" or "" to dispatch in FIFO order.
+	fairShare string
+	// weights are the relative weights of each user or realm. Defaults to 1.
+	weights map[string]float64
+	// quotas limit the pending and running tasks per tag or user.
+	quotas []*quotaState
+	// newTask creates a new task, used to trigger the schedules.
+	newTask func(ctx context.Context, r *model.TaskRequest, now time.Time) (*model.TaskResult, error)
+	// schedulesMu serializes the schedules modifications.
+	schedulesMu sync.Mutex
+	// clock returns the current time. It is overridden by the simulator and the
+	// tests.
+	clock func() time.Time
+	// resultMu serializes the TaskResult updates, see updateResult. It is
+	// locked before mu.
+	resultMu sync.Mutex
+
+	mu sync.Mutex
+	// bots are the bots currently waiting for a task, keyed by bot ID.
+	bots map[string]*waitingBot
+	// known is the index of which queues each bot that polled can serve, keyed
+	// by bot ID.
+	known map[string]*knownBot
+	// dimensions is the index of the dimensions of the known bots, as the
+	// number of bots having each value, keyed by dimension key then value.
+	dimensions map[string]map[string]int
+	// caches is the index of the named caches held by the known bots, keyed by
+	// cache name.
+	caches map[string]*namedCache
+	// queues are the task queues, keyed by hashDimensions. Each bucket is a
+	// slice to handle hash collisions.
+	queues map[uint64][]*taskQueue
+	// expirations are all the pending tasks, ordered by the expiration of their
+	// current slice.
+	expirations expiringTasks
+	// tasks are all the pending tasks, keyed by task key.
+	tasks map[int64]*pendingTask
+	// running is the task each bot is running, keyed by bot ID.
+	running map[string]runningTask
+	// owners are the users or realms with pending or running tasks.
+	owners map[string]*owner
+}
+
+// owner is a user or realm, as selected by scheduler.fairShare.
+type owner struct {
+	pending int
+	running int
 }
 
+type runningTask struct {
+	key      int64
+	owner    string
+	priority int32
+	try      int32
+	started  time.Time
+	quotas   []*quotaState
+	// preempting is set when the task is being killed to run a task with a
+	// higher priority.
+	preempting bool
+}
+
+// taskQueue is a distinct set of requested dimensions.
 type taskQueue struct {
-	dimensions map[string]string
-	bots       []string
-	lastSeen   time.Time
+	hash       uint64
+	dimensions map[string][]string
+	// bots are the waiting bots that can serve this queue.
+	bots map[string]*waitingBot
+	// matching is the number of known bots that can serve this queue.
+	matching int
+	// pending are the tasks waiting for a bot keyed by owner, each ordered by
+	// higherPriority.
+	pending map[string]*pendingTasks
+	// lastSeen is the last time a task used this queue. Idle queues are
+	// evicted by evictQueues.
+	lastSeen time.Time
+	// validUntil is when the last task pushed to this queue expires.
+	validUntil time.Time
+	stats      queueStats
+}
+
+// queueStats are the statistics of the tasks started from a taskQueue, used to
+// estimate when the pending tasks will start.
+type queueStats struct {
+	// samples is the number of tasks started.
+	samples int
+	// latency is the moving average of the time the tasks waited for a bot.
+	latency time.Duration
+	// interval is the moving average of the time between two tasks starting
+	// while the second was already waiting, i.e. how fast the queue drains
+	// when it is backlogged.
+	interval  time.Duration
+	lastStart time.Time
+}
+
+// statsWeight is the weight of a new sample in the moving averages.
+const statsWeight = 0.1
+
+// add records a task that waited since a time and started.
+func (q *queueStats) add(since, started time.Time) {
+	l := started.Sub(since)
+	if l < 0 {
+		l = 0
+	}
+	if q.samples == 0 {
+		q.latency = l
+	} else {
+		q.latency += time.Duration(statsWeight * float64(l-q.latency))
+	}
+	q.samples++
+	if !q.lastStart.IsZero() && since.Before(q.lastStart) && started.After(q.lastStart) {
+		i := started.Sub(q.lastStart)
+		if q.interval == 0 {
+			q.interval = i
+		} else {
+			q.interval += time.Duration(statsWeight * float64(i-q.interval))
+		}
+	}
+	if started.After(q.lastStart) {
+		q.lastStart = started
+	}
+}
+
+// pendingTask is a task waiting for a bot in a taskQueue.
+type pendingTask struct {
+	r *model.TaskRequest
+	// slice is the index of the current task slice.
+	slice int
+	// try is the try number of the next run.
+	try int32
+	// avoid is the bot whose run of the task died. The task only runs on it
+	// again if no other known bot can run it.
+	avoid string
+	owner string
+	// expiration is when the current slice expires.
+	expiration time.Time
+	// q is the queue for the current slice.
+	q *taskQueue
+	// qIndex and eIndex are the indexes in the owner's q.pending and
+	// scheduler.expirations.
+	qIndex int
+	eIndex int
+}
+
+// knownBot caches the queues a bot can serve, so it is only recalculated when
+// the bot's dimensions change.
+type knownBot struct {
+	hash       uint64
+	dimensions map[string][]string
+	queues     []*taskQueue
+	// caches are the named caches the bot holds and their size, as reported in
+	// its state.
+	caches map[string]int64
+}
+
+// namedCache is the aggregated information about a named cache across the
+// known bots.
+type namedCache struct {
+	// bots is the number of bots holding this cache.
+	bots int
+	// sized is the number of bots that reported the cache size, and size is
+	// the sum of the reported sizes.
+	sized int
+	size  int64
 }
 
 type waitingBot struct {
 	bot *model.Bot
-	ch  chan *model.TaskRequest
+	ch  chan *pendingTask
+	// claimed is set when a task was sent to ch. Protected by scheduler.mu.
+	claimed bool
+}
+
+// assignment is a pending task assigned to a waiting bot. It must be passed to
+// send once the lock is released.
+type assignment struct {
+	w *waitingBot
+	t *pendingTask
 }
 
 func (s *scheduler) init(db model.DB) {
+	s.tables = db
 	s.bots = map[string]*waitingBot{}
-	s.queues = map[uint64][]taskQueue{}
-	/*
-		reqs, _ := db.TaskRequestSlice("", 1000, time.Now().Sub(time.Hour), tim.Time{})
-		for _, r := range reqs {
-			h := hashDimensions(r.Dimensions)
-			s.queues[h] = append(s.queues[h], taskQueue{dimensions: r.Dimensions, lastSeen: r.Created})
+	s.known = map[string]*knownBot{}
+	s.dimensions = map[string]map[string]int{}
+	s.caches = map[string]*namedCache{}
+	s.queues = map[uint64][]*taskQueue{}
+	s.tasks = map[int64]*pendingTask{}
+	s.running = map[string]runningTask{}
+	s.owners = map[string]*owner{}
+	// Bootstrap the queues from the recent requests so bots get indexed
+	// against them on their first poll, and seed their statistics.
+	type start struct {
+		q              *taskQueue
+		since, started time.Time
+	}
+	var starts []start
+	cutoff := time.Now().Add(-time.Hour)
+	reqs, _ := db.TaskRequestSlice(model.Filter{Limit: 1000})
+	for i := range reqs {
+		if r := &reqs[i]; r.Created.After(cutoff) {
+			for j := range r.TaskSlices {
+				s.getQueueLocked(r.TaskSlices[j].Properties.Dimensions, r.Created)
+			}
+			res := model.TaskResult{}
+			db.TaskResultGet(r.Key, &res)
+			if slice := int(res.CurrentTaskSlice); !res.Started.IsZero() && res.DedupedFrom == 0 && slice < len(r.TaskSlices) {
+				q := s.getQueueLocked(r.TaskSlices[slice].Properties.Dimensions, r.Created)
+				starts = append(starts, start{q, sliceStart(r, slice), res.Started})
+			}
 		}
-	*/
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].started.Before(starts[j].started) })
+	for _, st := range starts {
+		st.q.stats.add(st.since, st.started)
+	}
+	// Load the bots that are not known to be dead, so tasks are not rejected
+	// with NO_RESOURCE until they poll again. The ones that are gone will be
+	// marked as dead by checkDeadBots.
+	bots, _ := db.BotGetSlice("", 10000)
+	for i := range bots {
+		if b := &bots[i]; !b.Dead && !b.Deleted {
+			s.botQueuesLocked(b)
+		}
+	}
+
+	// Rebuild the state from the tasks that were in flight when the server was
+	// last stopped.
+	now := time.Now().UTC()
+	f := model.Filter{Limit: 100000}
+	pending, _ := db.TaskResultSlice("", f, model.TaskStateQueryPending, model.TaskSortCreated)
+	for i := range pending {
+		r := &model.TaskRequest{}
+		db.TaskRequestGet(pending[i].Key, r)
+		slice := int(pending[i].CurrentTaskSlice)
+		p := &pendingTask{r: r, slice: slice, try: pending[i].TryNumber + 1, expiration: sliceExpiration(r, slice)}
+		if runs := pending[i].PreviousRuns; len(runs) != 0 && runs[len(runs)-1].State == model.BotDied {
+			p.avoid = runs[len(runs)-1].BotID
+		}
+		s.pushLocked(p, now)
+	}
+	running, _ := db.TaskResultSlice("", f, model.TaskStateQueryRunning, model.TaskSortCreated)
+	for i := range running {
+		res := &running[i]
+		if s.known[res.BotID] != nil {
+			// Reconciled when the bot polls again or is found dead.
+			r := model.TaskRequest{}
+			db.TaskRequestGet(res.Key, &r)
+			s.setRunningLocked(res.BotID, &r, res.TryNumber, res.Started)
+		} else {
+			s.botDied(res.Key, res.BotID, "bot died", now)
+		}
+	}
+}
+
+// botDimensions returns the dimensions of all the known bots.
+func (s *scheduler) botDimensions() map[string][]string {
+	s.mu.Lock()
+	dims := make(map[string][]string, len(s.dimensions))
+	for k, values := range s.dimensions {
+		l := make([]string, 0, len(values))
+		for v := range values {
+			l = append(l, v)
+		}
+		sort.Strings(l)
+		dims[k] = l
+	}
+	s.mu.Unlock()
+	return dims
 }
 
 // loop is the main omniscient scheduling loop.
+//
+// It triggers the schedules, expires the pending tasks, dispatches the tasks
+// that were held by a quota, preempts low priority tasks and looks for dead
+// bots.
 func (s *scheduler) loop(ctx context.Context) {
-	<-ctx.Done()
+	done := ctx.Done()
+	var lastDead time.Time
+	for {
+		select {
+		case now := <-time.After(10 * time.Second):
+			now = now.UTC()
+			s.runSchedules(ctx, now)
+			s.expire(now)
+			s.dispatch(now)
+			s.preempt(now)
+			s.evictQueues(now)
+			if now.Sub(lastDead) >= time.Minute {
+				s.checkDeadBots(now)
+				lastDead = now
+			}
+		case <-done:
+			return
+		}
+	}
 }
 
 // enqueue registers a task and tries to assign it to a bot inline.
 //
-// Returns true if it got scheduled.
-// the resulting TaskResult.
-func (s *scheduler) enqueue(ctx context.Context, r *model.TaskRequest, res *model.TaskResult) bool {
-	// Try to find a bot readily available. If not, skip.
-	// TODO(maruel): Precompute task queues.
-	scheduled := false
-	s.mu.Lock()
-	// Fast path for slow naive version without precomputation.
-	for id, w := range s.bots {
-		if dimensionsMatch(r.TaskSlices[0].Properties.Dimensions, w.bot.Dimensions) {
-			w.ch <- r
-			res.BotID = id
-			res.BotVersion = w.bot.Version
-			res.BotDimensions = w.bot.Dimensions
-			// res.BotIdleSince
-			res.CurrentTaskSlice = 0
-			res.Started = time.Now().UTC()
-			res.Modified = res.Started
-			res.State = model.Running
-			scheduled = true
-			break
-		}
+// The task must have been admitted and its TaskResult must already be saved as
+// pending. The slices that no known bot can run are skipped and the task is
+// marked as NO_RESOURCE if none is left. Otherwise the task is kept pending
+// until a bot polls for it or its slices expire. res is reloaded once done.
+func (s *scheduler) enqueue(ctx context.Context, r *model.TaskRequest, res *model.TaskResult) {
+	// Try to find a bot readily available. If not, queue it.
+	now := s.now()
+	s.expire(now)
+	p := &pendingTask{r: r, try: 1}
+	s.mu.Lock()
+	s.releaseLocked(r)
+	// Skip the slices that no known bot can run.
+	for p.slice < len(r.TaskSlices) && !s.hasCapacityLocked(&r.TaskSlices[p.slice], now) {
+		p.slice++
 	}
 	s.mu.Unlock()
-	return scheduled
+	if p.slice != 0 {
+		s.updateResult(r.Key, func(res *model.TaskResult) bool {
+			if res.State != model.Pending {
+				return false
+			}
+			if p.slice == len(r.TaskSlices) {
+				res.State = model.NoResource
+				res.Abandoned = now
+			} else {
+				res.CurrentTaskSlice = int32(p.slice)
+			}
+			res.Modified = now
+			return true
+		})
+	}
+	if p.slice != len(r.TaskSlices) {
+		p.expiration = sliceExpiration(r, p.slice)
+		s.mu.Lock()
+		w, t := s.pushLocked(p, now)
+		s.mu.Unlock()
+		if w != nil {
+			// t may be another task pending in this queue that goes first, e.g. it
+			// has a higher priority.
+			s.send(&assignment{w, t}, now)
+		} else if !now.Before(p.expiration) {
+			// The task was created a while ago, e.g. the server was restarted.
+			s.expire(now)
+		}
+	}
+	s.tables.TaskResultGet(r.Key, res)
 }
 
 // poll is a bot poll, waiting for tasks.
-func (s *scheduler) poll(ctx context.Context, bot *model.Bot) *model.TaskRequest {
-	// TODO(maruel): Look for pending tasks.
-
+//
+// Returns the task and the index of the slice to run, if any.
+func (s *scheduler) poll(ctx context.Context, bot *model.Bot) (*model.TaskRequest, int) {
 	// The Swarming bot currently has a read timeout of 60s.
 	// TODO(maruel): increase it upstream.
 	const pollHang = 30 * time.Second
-	w := waitingBot{bot: bot, ch: make(chan *model.TaskRequest)}
-	s.mu.Lock()
-	s.bots[bot.Key] = &w
-	s.mu.Unlock()
+	now := s.now()
+	s.expire(now)
+	t, w := s.pollNow(bot, now)
+	if t != nil {
+		return t.r, t.slice
+	}
 
-	// Register a channel.
 	// Wait for it.
-	var t *model.TaskRequest
 	select {
 	case <-time.After(pollHang):
+	case <-ctx.Done():
 	case t = <-w.ch:
 	}
+	if t == nil {
+		s.mu.Lock()
+		claimed := w.claimed
+		if !claimed {
+			s.removeWaitingLocked(w)
+		}
+		s.mu.Unlock()
+		if !claimed {
+			return nil, 0
+		}
+		// A task was assigned concurrently with the timeout. It is in flight.
+		t = <-w.ch
+	}
+	return t.r, t.slice
+}
+
+// pollNow is the non-blocking part of a bot poll.
+//
+// Returns the task to run if one is pending, otherwise the bot is registered as
+// waiting and the task will be sent to the returned waitingBot's channel.
+func (s *scheduler) pollNow(bot *model.Bot, now time.Time) (*pendingTask, *waitingBot) {
+	w := &waitingBot{bot: bot, ch: make(chan *pendingTask, 1)}
+	s.mu.Lock()
+	if old := s.bots[bot.Key]; old != nil {
+		// A previous poll from this bot is still hanging around.
+		s.removeWaitingLocked(old)
+	}
+	// The bot is not running anything since it is polling. If the task it was
+	// running is not completed, the bot lost it, e.g. it was restarted.
+	prev := s.clearRunningLocked(bot.Key)
+	s.mu.Unlock()
+	if prev != 0 {
+		s.botDied(prev, bot.Key, "bot died", now)
+	}
+	s.mu.Lock()
+	qs := s.botQueuesLocked(bot)
+	// Look for pending tasks first.
+	if t := s.claimLocked(qs, bot.Key, now); t != nil {
+		s.setRunningLocked(bot.Key, t.r, t.try, now)
+		s.mu.Unlock()
+		s.start(t, bot, now)
+		return t, nil
+	}
+	for _, q := range qs {
+		q.bots[bot.Key] = w
+	}
+	s.bots[bot.Key] = w
+	s.mu.Unlock()
+	return nil, w
+}
+
+// now returns the current time.
+func (s *scheduler) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now().UTC()
+}
+
+// expire moves the pending tasks whose current slice expired to their next
+// slice, and marks them as expired after their last slice.
+//
+// Like on enqueue, the slices that no known bot can run are skipped. When it
+// is the case of the last slice, the task is marked as NO_RESOURCE.
+func (s *scheduler) expire(now time.Time) {
+	var moved, expired, noResource []*pendingTask
+	var assigned []assignment
+	s.mu.Lock()
+	for len(s.expirations) != 0 && !now.Before(s.expirations[0].expiration) {
+		p := s.expirations[0]
+		s.removeLocked(p)
+		// Skip all the slices that already expired, which happens if the
+		// scheduler wasn't running for a while.
+		capacity := true
+		for p.slice++; p.slice < len(p.r.TaskSlices); p.slice++ {
+			t := &p.r.TaskSlices[p.slice]
+			p.expiration = p.expiration.Add(t.Expiration)
+			if capacity = s.hasCapacityLocked(t, now); capacity && now.Before(p.expiration) {
+				break
+			}
+		}
+		if p.slice == len(p.r.TaskSlices) {
+			if capacity {
+				expired = append(expired, p)
+			} else {
+				noResource = append(noResource, p)
+			}
+			continue
+		}
+		moved = append(moved, p)
+		if w, t := s.pushLocked(p, now); w != nil {
+			assigned = append(assigned, assignment{w, t})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, p := range moved {
+		s.updateResult(p.r.Key, func(res *model.TaskResult) bool {
+			if res.State != model.Pending {
+				return false
+			}
+			res.CurrentTaskSlice = int32(p.slice)
+			res.Modified = now
+			return true
+		})
+	}
+	for _, p := range expired {
+		s.abandon(p.r.Key, model.Expired, now)
+	}
+	for _, p := range noResource {
+		s.abandon(p.r.Key, model.NoResource, now)
+	}
+	for i := range assigned {
+		s.send(&assigned[i], now)
+	}
+}
+
+// abandon saves that a pending task was removed from its queue without
+// running.
+func (s *scheduler) abandon(key int64, state model.TaskState, now time.Time) {
+	s.updateResult(key, func(res *model.TaskResult) bool {
+		if res.State != model.Pending {
+			return false
+		}
+		res.State = state
+		res.Abandoned = now
+		res.Modified = now
+		return true
+	})
+}
+
+// checkDeadBots marks the bots that stopped pinging the server as dead, along
+// with the task they were running.
+func (s *scheduler) checkDeadBots(now time.Time) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.known))
+	for id := range s.known {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	cutoff := now.Add(-model.DeadAfter)
+	for _, id := range ids {
+		bot := model.Bot{}
+		s.tables.BotGet(id, &bot)
+		if !bot.Deleted && !bot.Dead && bot.LastSeen.After(cutoff) {
+			continue
+		}
+		s.mu.Lock()
+		if w := s.bots[id]; w != nil {
+			s.removeWaitingLocked(w)
+		}
+		s.removeKnownLocked(id)
+		taskID := s.clearRunningLocked(id)
+		s.mu.Unlock()
+		if bot.Deleted || bot.Dead {
+			continue
+		}
+
+		bot.Dead = true
+		bot.TaskID = 0
+		s.tables.BotSet(&bot)
+		msg := ""
+		if taskID != 0 && s.botDied(taskID, id, "bot died", now) {
+			msg = "task retried"
+		}
+		e := model.BotEvent{}
+		e.InitFrom(&bot, now, "bot_missing", msg)
+		e.TaskID = taskID
+		s.tables.BotEventAdd(&e)
+	}
+}
+
+// botDied handles a running task whose bot died or failed to run it, with the
+// failure as the reason.
+//
+// Like Swarming, an idempotent task is retried once as long as its current
+// slice didn't expire. The retry runs on another bot if possible. Returns true
+// if the task was retried.
+func (s *scheduler) botDied(key int64, botID, failure string, now time.Time) bool {
+	var a *assignment
+	retried := false
+	s.updateResult(key, func(res *model.TaskResult) bool {
+		if res.State != model.Running || res.BotID != botID {
+			return false
+		}
+		if res.Killing && res.PreemptedBy == 0 {
+			// The task was canceled, it is not retried.
+			res.State = model.Killed
+			res.Abandoned = now
+			res.Modified = now
+			return true
+		}
+		r := &model.TaskRequest{}
+		s.tables.TaskRequestGet(key, r)
+		slice := int(res.CurrentTaskSlice)
+		retry := r.TaskSlices[slice].Properties.Idempotent && res.TryNumber < model.MaxTryNumber && now.Before(sliceExpiration(r, slice))
+		for i := range res.PreviousRuns {
+			if res.PreviousRuns[i].State == model.BotDied {
+				// It was already retried. The preempted runs do not count.
+				retry = false
+			}
+		}
+		if !retry {
+			res.State = model.BotDied
+			res.InternalFailure = failure
+			res.Abandoned = now
+			res.Modified = now
+			return true
+		}
+		a = s.requeue(r, res, model.BotDied, failure, now)
+		retried = true
+		return true
+	})
+	if a != nil {
+		s.send(a, now)
+	}
+	return retried
+}
+
+// requeue saves the current run of a task in PreviousRuns and puts the task
+// back in its queue.
+//
+// It must be called from an updateResult callback. If a bot was waiting for
+// the task, the returned assignment must be sent once the callback returned.
+func (s *scheduler) requeue(r *model.TaskRequest, res *model.TaskResult, state model.TaskState, failure string, now time.Time) *assignment {
+	slice := int(res.CurrentTaskSlice)
+	p := &pendingTask{r: r, slice: slice, try: res.TryNumber + 1, expiration: sliceExpiration(r, slice)}
+	if state == model.BotDied {
+		p.avoid = res.BotID
+	}
+	res.PreviousRuns = append(res.PreviousRuns, model.TaskRun{
+		TryNumber:       res.TryNumber,
+		BotID:           res.BotID,
+		BotVersion:      res.BotVersion,
+		BotDimensions:   res.BotDimensions,
+		State:           state,
+		InternalFailure: failure,
+		Started:         res.Started,
+		Abandoned:       now,
+	})
+	// The next run starts from scratch.
+	res.State = model.Pending
+	res.BotID = ""
+	res.BotVersion = ""
+	res.BotDimensions = nil
+	res.TaskOutput = model.TaskOutput{}
+	res.ExitCode = 0
+	res.InternalFailure = ""
+	res.Output = model.Digest{}
+	res.CIPDClientUsed = model.CIPDPackage{}
+	res.CIPDPins = nil
+	res.Duration = 0
+	res.Started = time.Time{}
+	res.Completed = time.Time{}
+	res.Cost = 0
+	res.Killing = false
+	res.PreemptedBy = 0
+	res.Perf = model.TaskPerfStats{}
+	res.Modified = now
+	if s.outputs != nil {
+		_ = s.outputs.Truncate(r.Key)
+	}
+	s.mu.Lock()
+	w, t := s.pushLocked(p, now)
+	s.mu.Unlock()
+	if w == nil {
+		return nil
+	}
+	return &assignment{w, t}
+}
+
+// preemptAfter is how long a task waits for a bot before it can preempt a
+// running task.
+const preemptAfter = 5 * time.Minute
+
+// preemptPriority is the minimum priority difference for a task to preempt a
+// running task. Remember that a lower value is a higher priority.
+const preemptPriority = 50
+
+// preempt kills a running task when a task with a much higher priority waited
+// for too long, because all the bots that can run it are busy with tasks of
+// much lower priority.
+//
+// The bot is told to stop the task on its next task_update, then the task is
+// requeued by requeuePreempted.
+func (s *scheduler) preempt(now time.Time) {
+	type victim struct {
+		botID string
+		key   int64
+		by    *model.TaskRequest
+	}
+	var victims []victim
+	s.mu.Lock()
+	for _, q := range s.sortedQueuesLocked() {
+		t := s.firstLocked(q, "")
+		if t == nil || len(q.bots) != 0 || now.Sub(t.r.Created) < preemptAfter {
+			continue
+		}
+		if isTerminateTask(t.r) {
+			// The bot terminates once done with its current task.
+			continue
+		}
+		v := ""
+		for id, rt := range s.running {
+			if !s.servesLocked(id, q) || rt.try >= model.MaxTryNumber {
+				// The task couldn't be requeued with a valid run ID.
+				continue
+			}
+			if rt.preempting || rt.priority < t.r.Priority+preemptPriority {
+				// A bot is running a task that is important enough.
+				v = ""
+				break
+			}
+			// Kill the lowest priority task, and the one that started last
+			// to lose as little work as possible.
+			if old, ok := s.running[v]; v == "" || !ok || rt.priority > old.priority || (rt.priority == old.priority && (rt.started.After(old.started) || (rt.started.Equal(old.started) && id < v))) {
+				v = id
+			}
+		}
+		if v == "" {
+			continue
+		}
+		rt := s.running[v]
+		rt.preempting = true
+		s.running[v] = rt
+		victims = append(victims, victim{botID: v, key: rt.key, by: t.r})
+	}
+	s.mu.Unlock()
+
+	for _, v := range victims {
+		killing := false
+		s.updateResult(v.key, func(res *model.TaskResult) bool {
+			// The task may have completed concurrently.
+			if res.State != model.Running || res.BotID != v.botID || res.Killing {
+				return false
+			}
+			res.Killing = true
+			res.PreemptedBy = v.by.Key
+			res.Modified = now
+			killing = true
+			return true
+		})
+		if !killing {
+			continue
+		}
+		bot := model.Bot{}
+		s.tables.BotGet(v.botID, &bot)
+		e := model.BotEvent{}
+		msg := fmt.Sprintf("preempted by task %s with priority %d", model.ToTaskID(v.by.Key), v.by.Priority)
+		e.InitFrom(&bot, now, "task_preempted", msg)
+		e.TaskID = v.key
+		s.tables.BotEventAdd(&e)
+	}
+}
+
+// requeuePreempted requeues a preempted task once its bot stopped it.
+//
+// Like requeue, it must be called from an updateResult callback.
+func (s *scheduler) requeuePreempted(r *model.TaskRequest, res *model.TaskResult, now time.Time) *assignment {
+	return s.requeue(r, res, model.Preempted, "", now)
+}
+
+// servesLocked returns true if a known bot can run the tasks of a queue.
+func (s *scheduler) servesLocked(botID string, q *taskQueue) bool {
+	if k := s.known[botID]; k != nil {
+		for _, q2 := range k.queues {
+			if q2 == q {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pushLocked adds a pending task to the queue of its current slice.
+//
+// If a bot is waiting on this queue, the task with the highest priority is
+// removed from the queue and returned along the bot. The caller must then call
+// start() and send the task to the bot.
+func (s *scheduler) pushLocked(p *pendingTask, now time.Time) (*waitingBot, *pendingTask) {
+	p.q = s.getQueueLocked(p.r.TaskSlices[p.slice].Properties.Dimensions, now)
+	p.owner = s.ownerOf(p.r)
+	h := p.q.pending[p.owner]
+	if h == nil {
+		h = &pendingTasks{}
+		p.q.pending[p.owner] = h
+	}
+	heap.Push(h, p)
+	heap.Push(&s.expirations, p)
+	s.tasks[p.r.Key] = p
+	if p.expiration.After(p.q.validUntil) {
+		p.q.validUntil = p.expiration
+	}
+	s.getOwnerLocked(p.owner).pending++
+	s.addPendingLocked(p.r, 1)
+	if len(p.q.bots) == 0 {
+		return nil, nil
+	}
+	t, w := s.nextLocked(p.q)
+	if w == nil {
+		// Held by a quota or avoiding the waiting bot.
+		return nil, nil
+	}
+	s.assignLocked(t, w, now)
+	return w, t
+}
+
+// nextLocked returns the pending task to run first in a queue and the waiting
+// bot that should run it, if any.
+func (s *scheduler) nextLocked(q *taskQueue) (*pendingTask, *waitingBot) {
+	t := s.firstLocked(q, "")
+	if t == nil {
+		return nil, nil
+	}
+	if w := s.pickBotLocked(q, t); w != nil {
+		return t, w
+	}
+	// The only waiting bot is the one the task avoids. Another task may run on
+	// it.
+	for id, w := range q.bots {
+		if t = s.firstLocked(q, id); t != nil {
+			return t, w
+		}
+	}
+	return nil, nil
+}
+
+// assignLocked removes a pending task from its queue and assigns it to a
+// waiting bot.
+func (s *scheduler) assignLocked(t *pendingTask, w *waitingBot, now time.Time) {
+	s.removeWaitingLocked(w)
+	w.claimed = true
+	t.q.stats.add(sliceStart(t.r, t.slice), now)
+	s.removeLocked(t)
+	s.setRunningLocked(w.bot.Key, t.r, t.try, now)
+}
+
+// dispatch assigns the pending tasks to the waiting bots that can run them.
+//
+// This is only needed for the tasks that were held by a quota when they were
+// enqueued, since a bot never waits while there is a runnable task it can
+// serve otherwise.
+func (s *scheduler) dispatch(now time.Time) {
+	if len(s.quotas) == 0 {
+		return
+	}
+	var assigned []assignment
+	s.mu.Lock()
+	for _, q := range s.sortedQueuesLocked() {
+		for len(q.bots) != 0 {
+			t, w := s.nextLocked(q)
+			if w == nil {
+				break
+			}
+			s.assignLocked(t, w, now)
+			assigned = append(assigned, assignment{w, t})
+		}
+	}
+	s.mu.Unlock()
+	for i := range assigned {
+		s.send(&assigned[i], now)
+	}
+}
+
+// pickBotLocked returns the waiting bot that should run a task, if any.
+//
+// The bot holding the most named caches used by the task is preferred, then
+// the lowest bot ID so the choice is deterministic. The bot the task avoids is
+// skipped.
+func (s *scheduler) pickBotLocked(q *taskQueue, t *pendingTask) *waitingBot {
+	caches := t.r.TaskSlices[t.slice].Properties.Caches
+	var best *waitingBot
+	bestHits := -1
+	for id, w := range q.bots {
+		if s.avoidsLocked(t, id) {
+			continue
+		}
+		hits := 0
+		if k := s.known[id]; k != nil {
+			for i := range caches {
+				if _, ok := k.caches[caches[i].Name]; ok {
+					hits++
+				}
+			}
+		}
+		if hits > bestHits || (hits == bestHits && id < best.bot.Key) {
+			best = w
+			bestHits = hits
+		}
+	}
+	return best
+}
+
+// sortedQueuesLocked returns all the task queues in a stable order, so the
+// scheduling decisions do not depend on the map iteration order.
+func (s *scheduler) sortedQueuesLocked() []*taskQueue {
+	hashes := make([]uint64, 0, len(s.queues))
+	for h := range s.queues {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	out := make([]*taskQueue, 0, len(hashes))
+	for _, h := range hashes {
+		out = append(out, s.queues[h]...)
+	}
+	return out
+}
+
+// removeLocked removes a pending task from its queue.
+func (s *scheduler) removeLocked(p *pendingTask) {
+	h := p.q.pending[p.owner]
+	heap.Remove(h, p.qIndex)
+	if len(*h) == 0 {
+		delete(p.q.pending, p.owner)
+	}
+	heap.Remove(&s.expirations, p.eIndex)
+	delete(s.tasks, p.r.Key)
+	p.q = nil
+	o := s.owners[p.owner]
+	o.pending--
+	s.cleanOwnerLocked(p.owner, o)
+	s.addPendingLocked(p.r, -1)
+}
+
+// claimLocked removes and returns the pending task to run first on a bot
+// across the queues, if any.
+func (s *scheduler) claimLocked(qs []*taskQueue, botID string, now time.Time) *pendingTask {
+	var best *pendingTask
+	for _, q := range qs {
+		if t := s.firstLocked(q, botID); t != nil && (best == nil || s.beforeLocked(t, best)) {
+			best = t
+		}
+	}
+	if best != nil {
+		best.q.stats.add(sliceStart(best.r, best.slice), now)
+		s.removeLocked(best)
+	}
+	return best
+}
+
+// firstLocked returns the pending task to run first in a queue, if any.
+//
+// The tasks held by a quota are skipped, along with the ones avoiding botID if
+// set.
+func (s *scheduler) firstLocked(q *taskQueue, botID string) *pendingTask {
+	var best *pendingTask
+	for _, h := range q.pending {
+		t := (*h)[0]
+		if !s.eligibleLocked(t, botID) {
+			// Look for the next task of this owner that isn't skipped. This is a
+			// linear search but only happens when a quota is reached or a task
+			// is retried.
+			t = nil
+			for _, t2 := range (*h)[1:] {
+				if (t == nil || higherPriority(t2.r, t.r)) && s.eligibleLocked(t2, botID) {
+					t = t2
+				}
+			}
+			if t == nil {
+				continue
+			}
+		}
+		if best == nil || s.beforeLocked(t, best) {
+			best = t
+		}
+	}
+	return best
+}
+
+// eligibleLocked returns true if a pending task can run now, on botID if set.
+func (s *scheduler) eligibleLocked(t *pendingTask, botID string) bool {
+	return s.runnableLocked(t.r) && !s.avoidsLocked(t, botID)
+}
+
+// avoidsLocked returns true if a task must not run on a bot because its
+// previous run died there, as long as other known bots can run it.
+func (s *scheduler) avoidsLocked(t *pendingTask, botID string) bool {
+	return botID != "" && botID == t.avoid && t.q.matching > 1
+}
+
+// beforeLocked returns true if task a should run before task b.
+//
+// With fair-share, the tasks of the owner with the lowest share of running
+// tasks go first within the same priority.
+func (s *scheduler) beforeLocked(a, b *pendingTask) bool {
+	if a.owner != b.owner && a.r.Priority == b.r.Priority {
+		if sa, sb := s.shareLocked(a.owner), s.shareLocked(b.owner); sa != sb {
+			return sa < sb
+		}
+	}
+	return higherPriority(a.r, b.r)
+}
+
+// ownerOf returns the owner of a task for fair-share.
+func (s *scheduler) ownerOf(r *model.TaskRequest) string {
+	switch s.fairShare {
+	case "user":
+		return r.User
+	case "realm":
+		return r.Realm
+	default:
+		return ""
+	}
+}
+
+// weight returns the fair-share weight of an owner.
+func (s *scheduler) weight(name string) float64 {
+	if w, ok := s.weights[name]; ok {
+		return w
+	}
+	return 1
+}
+
+// shareLocked returns the number of running tasks of an owner, relative to its
+// weight.
+func (s *scheduler) shareLocked(name string) float64 {
+	o := s.owners[name]
+	if o == nil {
+		return 0
+	}
+	return float64(o.running) / s.weight(name)
+}
+
+func (s *scheduler) getOwnerLocked(name string) *owner {
+	o := s.owners[name]
+	if o == nil {
+		o = &owner{}
+		s.owners[name] = o
+	}
+	return o
+}
+
+func (s *scheduler) cleanOwnerLocked(name string, o *owner) {
+	if o.pending == 0 && o.running == 0 {
+		delete(s.owners, name)
+	}
+}
+
+// setRunningLocked records the task a bot is running.
+func (s *scheduler) setRunningLocked(botID string, r *model.TaskRequest, try int32, started time.Time) {
+	s.clearRunningLocked(botID)
+	owner := s.ownerOf(r)
+	qs := s.quotasOf(r)
+	s.running[botID] = runningTask{key: r.Key, owner: owner, priority: r.Priority, try: try, started: started, quotas: qs}
+	s.getOwnerLocked(owner).running++
+	for _, q := range qs {
+		q.running++
+	}
+}
+
+// clearRunningLocked forgets the task a bot was running and returns its key,
+// if any.
+func (s *scheduler) clearRunningLocked(botID string) int64 {
+	t, ok := s.running[botID]
+	if !ok {
+		return 0
+	}
+	delete(s.running, botID)
+	o := s.owners[t.owner]
+	o.running--
+	s.cleanOwnerLocked(t.owner, o)
+	for _, q := range t.quotas {
+		q.running--
+	}
+	return t.key
+}
+
+// shares returns the fair-share state of each owner with pending or running
+// tasks, sorted by name.
+func (s *scheduler) shares() []messapi.SchedulerShare {
+	s.mu.Lock()
+	out := make([]messapi.SchedulerShare, 0, len(s.owners))
+	for name, o := range s.owners {
+		out = append(out, messapi.SchedulerShare{
+			Name:    name,
+			Weight:  s.weight(name),
+			Pending: o.pending,
+			Running: o.running,
+			Share:   s.shareLocked(name),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// taskQueues returns the task queues that have pending tasks or that may get
+// more, sorted by dimensions, starting after cursor. Returns the cursor for
+// the next page, if any.
+func (s *scheduler) taskQueues(cursor string, limit int, now time.Time) ([]messapi.TaskQueue, string, error) {
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", errors.New("invalid cursor")
+	}
+	type item struct {
+		key string
+		q   messapi.TaskQueue
+	}
+	var items []item
 	s.mu.Lock()
-	delete(s.bots, bot.Key)
+	for _, qs := range s.queues {
+		for _, q := range qs {
+			if len(q.pending) == 0 && !now.Before(q.validUntil) {
+				continue
+			}
+			dims := make([]string, 0, len(q.dimensions))
+			for _, p := range messapi.ToRepeatedStringPairs(q.dimensions) {
+				dims = append(dims, p.Key+":"+p.Value)
+			}
+			key := strings.Join(dims, "\x00")
+			if len(after) != 0 && key <= string(after) {
+				continue
+			}
+			i := item{key: key, q: messapi.TaskQueue{Dimensions: dims, ValidUntil: messapi.CloudTime(q.validUntil), Bots: q.matching}}
+			var oldest time.Time
+			for _, h := range q.pending {
+				i.q.Pending += len(*h)
+				for _, t := range *h {
+					if oldest.IsZero() || t.r.Created.Before(oldest) {
+						oldest = t.r.Created
+					}
+				}
+			}
+			if !oldest.IsZero() {
+				i.q.OldestPendingSecs = now.Sub(oldest).Seconds()
+			}
+			items = append(items, i)
+		}
+	}
 	s.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	next := ""
+	if len(items) > limit {
+		items = items[:limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(items[limit-1].key))
+	}
+	out := make([]messapi.TaskQueue, len(items))
+	for i := range items {
+		out[i] = items[i].q
+	}
+	return out, next, nil
+}
+
+// eta returns when a pending task is estimated to start. Returns false if the
+// task is not pending or the estimate is unknown.
+func (s *scheduler) eta(key int64, now time.Time) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.tasks[key]
+	if p == nil {
+		return time.Time{}, false
+	}
+	ahead := 0
+	for _, h := range p.q.pending {
+		for _, t := range *h {
+			if t != p && s.beforeLocked(t, p) {
+				ahead++
+			}
+		}
+	}
+	d, ok := s.estimateLocked(p.q, ahead, now.Sub(sliceStart(p.r, p.slice)))
+	return now.Add(d), ok
+}
+
+// queueStats returns the statistics of the task queue for these dimensions,
+// and the estimated start of a new task with this priority. Returns false if
+// there is no such queue.
+func (s *scheduler) queueStats(dims map[string][]string, priority int32, now time.Time) (messapi.TaskQueueStatsResponse, bool) {
+	out := messapi.TaskQueueStatsResponse{Now: messapi.CloudTime(now)}
+	h := hashDimensions(dims)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues[h] {
+		if !sameDimensions(q.dimensions, dims) {
+			continue
+		}
+		for _, p := range messapi.ToRepeatedStringPairs(q.dimensions) {
+			out.Dimensions = append(out.Dimensions, p.Key+":"+p.Value)
+		}
+		ahead := 0
+		for _, h := range q.pending {
+			out.Pending += len(*h)
+			for _, t := range *h {
+				if t.r.Priority <= priority {
+					ahead++
+				}
+			}
+		}
+		out.Bots = q.matching
+		out.WaitingBots = len(q.bots)
+		out.Samples = q.stats.samples
+		out.AvgPendingSecs = q.stats.latency.Seconds()
+		out.AvgStartIntervalSecs = q.stats.interval.Seconds()
+		if d, ok := s.estimateLocked(q, ahead, 0); ok {
+			out.EstimatedStart = messapi.CloudTime(now.Add(d))
+		}
+		return out, true
+	}
+	return out, false
+}
+
+// estimateLocked returns how long a task will wait in a queue, given the
+// number of pending tasks that will run before it and how long it already
+// waited. Returns false if no bot can run it or there is no history yet.
+//
+// When the queue was recently backlogged, the estimate is based on how fast it
+// drained. Otherwise it is based on how long the tasks usually wait.
+func (s *scheduler) estimateLocked(q *taskQueue, ahead int, waited time.Duration) (time.Duration, bool) {
+	if q.matching == 0 {
+		return 0, false
+	}
+	if ahead == 0 && len(q.bots) != 0 {
+		return 0, true
+	}
+	if q.stats.samples == 0 {
+		return 0, false
+	}
+	d := q.stats.latency - waited
+	if q.stats.interval != 0 {
+		d = time.Duration(ahead+1) * q.stats.interval
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+// start saves that a pending task was assigned to a bot.
+func (s *scheduler) start(t *pendingTask, bot *model.Bot, now time.Time) {
+	s.updateResult(t.r.Key, func(res *model.TaskResult) bool {
+		if res.State != model.Pending {
+			return false
+		}
+		setRunning(res, t.r, bot, t.slice, now)
+		return true
+	})
+}
+
+// send starts a task assigned to a waiting bot and sends it to the bot.
+func (s *scheduler) send(a *assignment, now time.Time) {
+	s.start(a.t, a.w.bot, now)
+	// The channel is buffered so this never blocks.
+	a.w.ch <- a.t
+}
+
+// updateResult serializes the read-modify-write of a TaskResult.
+//
+// f is called with the current TaskResult and returns true if it must be
+// saved. f must recheck the state since it may have changed concurrently, and
+// must not call updateResult.
+func (s *scheduler) updateResult(key int64, f func(res *model.TaskResult) bool) {
+	s.resultMu.Lock()
+	defer s.resultMu.Unlock()
+	res := model.TaskResult{}
+	s.tables.TaskResultGet(key, &res)
+	if f(&res) {
+		s.tables.TaskResultSet(&res)
+	}
+}
+
+// getQueueLocked returns the task queue for these dimensions, creating it if
+// needed.
+//
+// When a queue is created, the known bots are indexed against it.
+func (s *scheduler) getQueueLocked(dims map[string][]string, now time.Time) *taskQueue {
+	h := hashDimensions(dims)
+	for _, q := range s.queues[h] {
+		if sameDimensions(q.dimensions, dims) {
+			if now.After(q.lastSeen) {
+				q.lastSeen = now
+			}
+			return q
+		}
+	}
+	q := &taskQueue{hash: h, dimensions: dims, bots: map[string]*waitingBot{}, pending: map[string]*pendingTasks{}, lastSeen: now}
+	s.queues[h] = append(s.queues[h], q)
+	for id, k := range s.known {
+		if dimensionsMatch(dims, k.dimensions) {
+			k.queues = append(k.queues, q)
+			q.matching++
+			if w := s.bots[id]; w != nil {
+				q.bots[id] = w
+			}
+		}
+	}
+	return q
+}
+
+// queueEvictAfter is how long a queue without pending tasks is kept, to keep
+// its statistics and the bots indexed against it.
+const queueEvictAfter = 24 * time.Hour
+
+// evictQueues removes the queues that had no pending task for
+// queueEvictAfter.
+//
+// Otherwise each distinct set of requested dimensions would be kept forever
+// and scanned on every bot dimensions change.
+func (s *scheduler) evictQueues(now time.Time) {
+	cutoff := now.Add(-queueEvictAfter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := map[*taskQueue]struct{}{}
+	for h, qs := range s.queues {
+		kept := qs[:0]
+		for _, q := range qs {
+			if len(q.pending) == 0 && q.lastSeen.Before(cutoff) && !now.Before(q.validUntil) {
+				evicted[q] = struct{}{}
+			} else {
+				kept = append(kept, q)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.queues, h)
+		} else {
+			s.queues[h] = kept
+		}
+	}
+	if len(evicted) == 0 {
+		return
+	}
+	for _, k := range s.known {
+		// Do not filter in place, the slice may be in use by a polling bot.
+		kept := make([]*taskQueue, 0, len(k.queues))
+		for _, q := range k.queues {
+			if _, ok := evicted[q]; !ok {
+				kept = append(kept, q)
+			}
+		}
+		k.queues = kept
+	}
+}
+
+// botQueuesLocked returns the task queues a bot can serve.
+func (s *scheduler) botQueuesLocked(bot *model.Bot) []*taskQueue {
+	h := hashDimensions(bot.Dimensions)
+	k := s.known[bot.Key]
+	if k == nil || k.hash != h {
+		s.removeKnownLocked(bot.Key)
+		k = &knownBot{hash: h, dimensions: bot.Dimensions}
+		for _, qs := range s.queues {
+			for _, q := range qs {
+				if dimensionsMatch(q.dimensions, bot.Dimensions) {
+					k.queues = append(k.queues, q)
+					q.matching++
+				}
+			}
+		}
+		for key, values := range bot.Dimensions {
+			m := s.dimensions[key]
+			if m == nil {
+				m = map[string]int{}
+				s.dimensions[key] = m
+			}
+			for _, v := range values {
+				m[v]++
+			}
+		}
+		s.known[bot.Key] = k
+	}
+	s.setCachesLocked(k, namedCaches(bot.State))
+	return k.queues
+}
+
+// removeKnownLocked removes a bot from the index of known bots.
+func (s *scheduler) removeKnownLocked(id string) {
+	k := s.known[id]
+	if k == nil {
+		return
+	}
+	for _, q := range k.queues {
+		q.matching--
+	}
+	s.setCachesLocked(k, nil)
+	for key, values := range k.dimensions {
+		m := s.dimensions[key]
+		for _, v := range values {
+			if m[v]--; m[v] == 0 {
+				delete(m, v)
+			}
+		}
+		if len(m) == 0 {
+			delete(s.dimensions, key)
+		}
+	}
+	delete(s.known, id)
+}
+
+// setCachesLocked updates the named caches held by a known bot.
+func (s *scheduler) setCachesLocked(k *knownBot, caches map[string]int64) {
+	for name, size := range k.caches {
+		c := s.caches[name]
+		if c.bots--; c.bots == 0 {
+			delete(s.caches, name)
+			continue
+		}
+		if size != 0 {
+			c.sized--
+			c.size -= size
+		}
+	}
+	for name, size := range caches {
+		c := s.caches[name]
+		if c == nil {
+			c = &namedCache{}
+			s.caches[name] = c
+		}
+		c.bots++
+		if size != 0 {
+			c.sized++
+			c.size += size
+		}
+	}
+	k.caches = caches
+}
+
+// cachesInstalled records that a bot now holds the named caches used by a task
+// it ran.
+//
+// The size is learned on the next bot poll, as part of its state.
+func (s *scheduler) cachesInstalled(botID string, caches []model.Cache) {
+	if len(caches) == 0 {
+		return
+	}
+	s.mu.Lock()
+	if k := s.known[botID]; k != nil {
+		m := make(map[string]int64, len(k.caches)+len(caches))
+		for name, size := range k.caches {
+			m[name] = size
+		}
+		for i := range caches {
+			if _, ok := m[caches[i].Name]; !ok {
+				m[caches[i].Name] = 0
+			}
+		}
+		s.setCachesLocked(k, m)
+	}
+	s.mu.Unlock()
+}
+
+// cacheHints returns the expected size of each named cache, as the average
+// size reported by the known bots holding it.
+func (s *scheduler) cacheHints(caches []model.Cache) []int64 {
+	out := make([]int64, len(caches))
+	s.mu.Lock()
+	for i := range caches {
+		if c := s.caches[caches[i].Name]; c != nil && c.sized != 0 {
+			out[i] = c.size / int64(c.sized)
+		}
+	}
+	s.mu.Unlock()
+	return out
+}
+
+// namedCaches returns the named caches and their size from a bot state.
+//
+// The bot reports the content of its named cache state.json, which is a
+// mapping of name to [[relative path, size], last used timestamp].
+func namedCaches(state []byte) map[string]int64 {
+	st := struct {
+		NamedCaches map[string][]json.RawMessage `json:"named_caches"`
+	}{}
+	if len(state) == 0 || json.Unmarshal(state, &st) != nil || len(st.NamedCaches) == 0 {
+		return nil
+	}
+	out := make(map[string]int64, len(st.NamedCaches))
+	for name, v := range st.NamedCaches {
+		size := int64(0)
+		var entry []interface{}
+		if len(v) != 0 && json.Unmarshal(v[0], &entry) == nil && len(entry) == 2 {
+			if f, ok := entry[1].(float64); ok {
+				size = int64(f)
+			}
+		}
+		out[name] = size
+	}
+	return out
+}
+
+// hasCapacityLocked returns true if a known bot can run this task slice, or if
+// the slice is meant to wait for one.
+func (s *scheduler) hasCapacityLocked(t *model.TaskSlice, now time.Time) bool {
+	return t.WaitForCapacity || s.getQueueLocked(t.Properties.Dimensions, now).matching != 0
+}
+
+// sliceStart returns when a task slice started, which is when the previous one
+// expired.
+func sliceStart(r *model.TaskRequest, slice int) time.Time {
+	return sliceExpiration(r, slice).Add(-r.TaskSlices[slice].Expiration)
+}
+
+// sliceExpiration returns when a task slice expires.
+//
+// Each slice starts when the previous one expired.
+func sliceExpiration(r *model.TaskRequest, slice int) time.Time {
+	exp := r.Created
+	for i := 0; i <= slice; i++ {
+		exp = exp.Add(r.TaskSlices[i].Expiration)
+	}
+	return exp
+}
+
+// setRunning updates a TaskResult once the task is assigned to a bot.
+func setRunning(res *model.TaskResult, r *model.TaskRequest, bot *model.Bot, slice int, now time.Time) {
+	res.BotID = bot.Key
+	res.BotVersion = bot.Version
+	res.BotDimensions = bot.Dimensions
+	// res.BotIdleSince
+	res.CurrentTaskSlice = int32(slice)
+	if p := &r.TaskSlices[slice].Properties; p.Idempotent {
+		// Successful results can then be reused by identical tasks.
+		res.PropertiesHash = p.Hash()
+	} else {
+		res.PropertiesHash = ""
+	}
+	res.Started = now
+	res.Modified = now
+	res.State = model.Running
+	res.TryNumber++
+}
+
+// removeWaitingLocked unregisters a waiting bot from the scheduler.
+func (s *scheduler) removeWaitingLocked(w *waitingBot) {
+	id := w.bot.Key
+	if s.bots[id] != w {
+		return
+	}
+	delete(s.bots, id)
+	if k := s.known[id]; k != nil {
+		for _, q := range k.queues {
+			delete(q.bots, id)
+		}
+	}
+}
+
+// pendingTasks is a priority queue of tasks. It implements heap.Interface.
+type pendingTasks []*pendingTask
+
+func (p pendingTasks) Len() int           { return len(p) }
+func (p pendingTasks) Less(i, j int) bool { return higherPriority(p[i].r, p[j].r) }
+
+func (p pendingTasks) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+	p[i].qIndex = i
+	p[j].qIndex = j
+}
+
+func (p *pendingTasks) Push(x interface{}) {
+	t := x.(*pendingTask)
+	t.qIndex = len(*p)
+	*p = append(*p, t)
+}
+
+func (p *pendingTasks) Pop() interface{} {
+	old := *p
+	l := len(old) - 1
+	t := old[l]
+	old[l] = nil
+	*p = old[:l]
+	return t
+}
+
+// expiringTasks is a priority queue of tasks ordered by the expiration of
+// their current slice. It implements heap.Interface.
+type expiringTasks []*pendingTask
+
+func (e expiringTasks) Len() int           { return len(e) }
+func (e expiringTasks) Less(i, j int) bool { return e[i].expiration.Before(e[j].expiration) }
+
+func (e expiringTasks) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+	e[i].eIndex = i
+	e[j].eIndex = j
+}
+
+func (e *expiringTasks) Push(x interface{}) {
+	t := x.(*pendingTask)
+	t.eIndex = len(*e)
+	*e = append(*e, t)
+}
+
+func (e *expiringTasks) Pop() interface{} {
+	old := *e
+	l := len(old) - 1
+	t := old[l]
+	old[l] = nil
+	*e = old[:l]
 	return t
 }
 
+// higherPriority returns true if a must be dispatched before b.
+//
+// The lowest priority number goes first, then FIFO within a priority.
+func higherPriority(a, b *model.TaskRequest) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if !a.Created.Equal(b.Created) {
+		return a.Created.Before(b.Created)
+	}
+	return a.Key < b.Key
+}
+
 //
 
 // murmurHash64A is 64bit MurmurHash2, by Austin Appleby.
@@ -144,7 +1639,7 @@ func murmurHash64A(data []byte) uint64 {
 	return h
 }
 
-func hashDimensions(dims map[string]string) uint64 {
+func hashDimensions(dims map[string][]string) uint64 {
 	b, err := json.Marshal(dims)
 	if err != nil {
 		panic(err)
@@ -152,23 +1647,56 @@ func hashDimensions(dims map[string]string) uint64 {
 	return murmurHash64A(b)
 }
 
-func dimensionsMatch(req map[string]string, bot map[string][]string) bool {
-	for k, v := range req {
+func sameDimensions(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		v2, ok := b[k]
+		if !ok || len(v) != len(v2) {
+			return false
+		}
+		for i := range v {
+			if v[i] != v2[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dimensionsMatch returns true if the bot has all the requested dimensions.
+//
+// A requested value can be alternatives separated by "|", in which case any of
+// them matches.
+func dimensionsMatch(req, bot map[string][]string) bool {
+	for k, values := range req {
 		vals := bot[k]
 		if len(vals) == 0 {
 			return false
 		}
+		for _, v := range values {
+			if !anyValue(v, vals) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// anyValue returns true if any of the "|" separated alternatives is in vals.
+func anyValue(alts string, vals []string) bool {
+	for {
+		v, rest, more := strings.Cut(alts, "|")
 		// Linear search since the number of items is very small.
-		found := false
 		for _, v2 := range vals {
 			if v == v2 {
-				found = true
-				break
+				return true
 			}
 		}
-		if !found {
+		if !more {
 			return false
 		}
+		alts = rest
 	}
-	return true
 }
@@ -0,0 +1,990 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+	"github.com/maruel/mess/messapi"
+)
+
+func TestEvictQueues(t *testing.T) {
+	s := newTestScheduler(t)
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.mu.Lock()
+	s.botQueuesLocked(&model.Bot{Key: "bot1", Dimensions: map[string][]string{"id": {"bot1"}, "os": {"Linux"}}})
+	old := s.getQueueLocked(map[string][]string{"id": {"bot1"}}, now)
+	recent := s.getQueueLocked(map[string][]string{"os": {"Linux"}}, now.Add(queueEvictAfter))
+	s.mu.Unlock()
+	if l := len(s.known["bot1"].queues); l != 2 {
+		t.Fatal(l)
+	}
+
+	s.evictQueues(now.Add(queueEvictAfter + time.Second))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := len(s.queues); l != 1 {
+		t.Fatal(l)
+	}
+	if qs := s.known["bot1"].queues; len(qs) != 1 || qs[0] != recent || qs[0] == old {
+		t.Fatal(qs)
+	}
+}
+
+func TestPickBotLockedNamedCaches(t *testing.T) {
+	s := newTestScheduler(t)
+	q := &taskQueue{bots: map[string]*waitingBot{}}
+	bots := map[string]map[string]int64{
+		"bot1": nil,
+		"bot2": {"git": 0},
+		"bot3": {"git": 100, "go": 50},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, caches := range bots {
+		k := &knownBot{}
+		s.known[id] = k
+		s.setCachesLocked(k, caches)
+		q.bots[id] = &waitingBot{bot: &model.Bot{Key: id}}
+	}
+	data := []struct {
+		caches []string
+		want   string
+	}{
+		// The lowest bot ID wins on a tie.
+		{nil, "bot1"},
+		{[]string{"other"}, "bot1"},
+		{[]string{"git"}, "bot2"},
+		{[]string{"go"}, "bot3"},
+		{[]string{"git", "go"}, "bot3"},
+	}
+	for i, l := range data {
+		p := &pendingTask{r: &model.TaskRequest{TaskSlices: []model.TaskSlice{{}}}}
+		for _, c := range l.caches {
+			p.r.TaskSlices[0].Properties.Caches = append(p.r.TaskSlices[0].Properties.Caches, model.Cache{Name: c, Path: c})
+		}
+		if got := s.pickBotLocked(q, p).bot.Key; got != l.want {
+			t.Errorf("#%d: %v: want %s, got %s", i, l.caches, l.want, got)
+		}
+	}
+}
+
+func TestCacheHints(t *testing.T) {
+	s := newTestScheduler(t)
+	s.mu.Lock()
+	for id, caches := range map[string]map[string]int64{"bot1": {"git": 0}, "bot2": {"git": 100, "go": 50}, "bot3": {"go": 150}} {
+		k := &knownBot{}
+		s.known[id] = k
+		s.setCachesLocked(k, caches)
+	}
+	s.mu.Unlock()
+	// The bots that didn't report the size yet are ignored.
+	got := s.cacheHints([]model.Cache{{Name: "git"}, {Name: "go"}, {Name: "other"}})
+	if want := []int64{100, 100, 0}; !reflect.DeepEqual(got, want) {
+		t.Fatal(got)
+	}
+	s.mu.Lock()
+	s.removeKnownLocked("bot2")
+	s.mu.Unlock()
+	got = s.cacheHints([]model.Cache{{Name: "git"}, {Name: "go"}})
+	if want := []int64{0, 150}; !reflect.DeepEqual(got, want) {
+		t.Fatal(got)
+	}
+}
+
+func TestNamedCaches(t *testing.T) {
+	data := []struct {
+		state string
+		want  map[string]int64
+	}{
+		{"", nil},
+		{"{}", nil},
+		{"invalid", nil},
+		{`{"named_caches":{}}`, nil},
+		{`{"named_caches":{"git":[["a1",1024],1577934245]}}`, map[string]int64{"git": 1024}},
+		// The size is unknown when the entry is malformed.
+		{`{"named_caches":{"git":[["a1"],1577934245],"go":[]}}`, map[string]int64{"git": 0, "go": 0}},
+	}
+	for i, l := range data {
+		if got := namedCaches([]byte(l.state)); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("#%d: %v", i, got)
+		}
+	}
+}
+
+func TestDimensionsMatch(t *testing.T) {
+	bot := map[string][]string{"id": {"bot1"}, "os": {"Linux", "Ubuntu", "Ubuntu-22.04"}, "pool": {"a"}}
+	data := []struct {
+		req  map[string][]string
+		want bool
+	}{
+		{nil, true},
+		{map[string][]string{"pool": {"a"}}, true},
+		{map[string][]string{"pool": {"b"}}, false},
+		{map[string][]string{"gpu": {"none"}}, false},
+		// Repeated keys: all values must match.
+		{map[string][]string{"os": {"Linux", "Ubuntu-22.04"}}, true},
+		{map[string][]string{"os": {"Linux", "Windows"}}, false},
+		// OR dimensions: any alternative matches.
+		{map[string][]string{"os": {"Mac|Linux"}, "pool": {"a"}}, true},
+		{map[string][]string{"os": {"Mac|Windows"}}, false},
+		{map[string][]string{"os": {"Mac|Linux", "Ubuntu-20.04|Ubuntu-22.04"}}, true},
+		{map[string][]string{"os": {"Mac|Linux", "Ubuntu-20.04"}}, false},
+	}
+	for i, l := range data {
+		if got := dimensionsMatch(l.req, bot); got != l.want {
+			t.Errorf("#%d: %v: want %t", i, l.req, l.want)
+		}
+	}
+}
+
+func TestAnyValue(t *testing.T) {
+	data := []struct {
+		alts string
+		vals []string
+		want bool
+	}{
+		{"a", []string{"a"}, true},
+		{"a", []string{"b", "a"}, true},
+		{"a", []string{"b"}, false},
+		{"a", nil, false},
+		{"a|b", []string{"b"}, true},
+		{"a|b|c", []string{"c"}, true},
+		{"a|b|c", []string{"d"}, false},
+		// No partial match.
+		{"a|b", []string{"a|b"}, false},
+		{"ab", []string{"a"}, false},
+	}
+	for i, l := range data {
+		if got := anyValue(l.alts, l.vals); got != l.want {
+			t.Errorf("#%d: %q in %v: want %t", i, l.alts, l.vals, l.want)
+		}
+	}
+}
+
+func TestPollClaimsPending(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	mac := newTestBot(s, "bot2", map[string][]string{"os": {"Mac"}})
+	// No bot is waiting when the task is created.
+	busyBot(t, s, bot)
+	res := newTestTask(t, s, testRequest(100, linux))
+	if res.State != model.Pending {
+		t.Fatal(res.State)
+	}
+	if got, w := s.sched.pollNow(mac, testNow); got != nil || w == nil {
+		t.Fatal(got)
+	}
+	got, w := s.sched.pollNow(bot, testNow)
+	if got == nil || w != nil || got.r.Key != res.Key || got.slice != 0 {
+		t.Fatal(got)
+	}
+	if res := getResult(s, res.Key); res.State != model.Running || res.BotID != "bot1" || res.TryNumber != 1 {
+		t.Fatalf("%+v", res)
+	}
+	// The task was claimed only once.
+	s.sched.mu.Lock()
+	defer s.sched.mu.Unlock()
+	if len(s.sched.tasks) != 0 {
+		t.Fatal(s.sched.tasks)
+	}
+}
+
+func TestPriorityOrder(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	gpu := map[string][]string{"gpu": {"none"}}
+	bot := newTestBot(s, "bot1", map[string][]string{"os": {"Linux"}, "gpu": {"none"}})
+	busyBot(t, s, bot)
+	data := []struct {
+		priority int32
+		created  time.Duration
+		dims     map[string][]string
+	}{
+		{200, 0, linux},
+		{100, 3 * time.Second, linux},
+		{50, 2 * time.Second, gpu},
+		{100, time.Second, linux},
+		// Same priority and creation time as the previous one.
+		{100, time.Second, gpu},
+	}
+	keys := make([]int64, len(data))
+	for i, l := range data {
+		r := testRequest(l.priority, l.dims)
+		r.Created = testNow.Add(l.created)
+		keys[i] = newTestTask(t, s, r).Key
+	}
+	// The lowest priority number first, then FIFO, across the bot's queues.
+	for i, want := range []int{2, 3, 4, 1, 0} {
+		got, _ := s.sched.pollNow(bot, testNow)
+		if got == nil || got.r.Key != keys[want] {
+			t.Fatalf("#%d: want task #%d, got %v", i, want, got)
+		}
+	}
+}
+
+func TestSliceFallback(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		expire []time.Duration
+		state  model.TaskState
+		slice  int32
+	}{
+		{[]time.Duration{59 * time.Second}, model.Pending, 0},
+		{[]time.Duration{time.Minute}, model.Pending, 1},
+		{[]time.Duration{time.Minute, time.Hour}, model.Pending, 1},
+		{[]time.Duration{time.Minute, time.Hour + time.Minute}, model.Expired, 1},
+		// All the slices expired while the scheduler wasn't running.
+		{[]time.Duration{2 * time.Hour}, model.Expired, 0},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		busyBot(t, s, bot)
+		r := testRequest(100, map[string][]string{"os": {"Linux"}, "gpu": {"nvidia"}})
+		r.TaskSlices[0].Expiration = time.Minute
+		r.TaskSlices[0].WaitForCapacity = true
+		r.TaskSlices = append(r.TaskSlices, model.TaskSlice{
+			Properties: model.TaskProperties{Command: []string{"fallback"}, Dimensions: linux},
+			Expiration: time.Hour,
+		})
+		res := newTestTask(t, s, r)
+		var now time.Time
+		for _, d := range l.expire {
+			now = testNow.Add(d)
+			s.sched.expire(now)
+		}
+		got := getResult(s, res.Key)
+		if got.State != l.state || got.CurrentTaskSlice != l.slice {
+			t.Fatalf("#%d: %d %d", i, got.State, got.CurrentTaskSlice)
+		}
+		if l.state == model.Expired {
+			if !got.Abandoned.Equal(now) {
+				t.Errorf("#%d: %s", i, got.Abandoned)
+			}
+			continue
+		}
+		// The bot can only run the second slice.
+		p, _ := s.sched.pollNow(bot, now)
+		if l.slice == 0 {
+			if p != nil {
+				t.Errorf("#%d: %v", i, p)
+			}
+			continue
+		}
+		if p == nil || p.slice != 1 {
+			t.Fatalf("#%d: %v", i, p)
+		}
+		m := botPollManifest{}
+		m.fromRequest(p.r, p.slice, make([]int64, len(p.r.TaskSlices[p.slice].Properties.Caches)))
+		if want := r.TaskSlices[l.slice].Properties.Command; !reflect.DeepEqual(m.Command, want) {
+			t.Errorf("#%d: %v", i, m.Command)
+		}
+	}
+}
+
+func TestCheckDeadBots(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	bot2 := newTestBot(s, "bot2", linux)
+	bot3 := newTestBot(s, "bot3", linux)
+	res := startTestTask(t, s, bot1, testRequest(100, linux))
+	s.sched.pollNow(bot2, testNow)
+	busyBot(t, s, bot3)
+	now := testNow.Add(model.DeadAfter + time.Second)
+	// bot3 is still pinging.
+	bot3.LastSeen = now
+	s.tables.BotSet(bot3)
+
+	s.sched.checkDeadBots(now)
+	data := []struct {
+		id   string
+		dead bool
+	}{
+		{"bot1", true},
+		{"bot2", true},
+		{"bot3", false},
+	}
+	for i, l := range data {
+		bot := model.Bot{}
+		s.tables.BotGet(l.id, &bot)
+		if bot.Dead != l.dead || bot.TaskID != 0 {
+			t.Errorf("#%d: %t %d", i, bot.Dead, bot.TaskID)
+		}
+		events, _ := s.tables.BotEventGetSlice(l.id, model.Filter{Limit: 10})
+		if l.dead != (len(events) == 1) {
+			t.Errorf("#%d: %+v", i, events)
+		} else if l.dead && events[0].Event != "bot_missing" {
+			t.Errorf("#%d: %+v", i, events[0])
+		}
+	}
+	if got := getResult(s, res.Key); got.State != model.BotDied || got.InternalFailure != "bot died" || !got.Abandoned.Equal(now) {
+		t.Fatalf("%+v", got)
+	}
+	// The dead bots are forgotten.
+	s.sched.mu.Lock()
+	defer s.sched.mu.Unlock()
+	if len(s.sched.known) != 1 || s.sched.known["bot3"] == nil || len(s.sched.bots) != 0 || len(s.sched.running) != 0 {
+		t.Fatal(s.sched.known, s.sched.bots, s.sched.running)
+	}
+}
+
+func TestInitReconcile(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	bot2 := newTestBot(s, "bot2", linux)
+	bot3 := newTestBot(s, "bot3", linux)
+	running := startTestTask(t, s, bot1, testRequest(100, linux))
+	orphan := startTestTask(t, s, bot2, testRequest(100, linux))
+	busyBot(t, s, bot3)
+	pending := newTestTask(t, s, testRequest(100, linux))
+	if pending.State != model.Pending {
+		t.Fatal(pending.State)
+	}
+	// bot2 was found dead before the restart.
+	bot2.Dead = true
+	s.tables.BotSet(bot2)
+
+	// Restart.
+	sched := &scheduler{clock: s.sched.clock, outputs: s.outputs}
+	sched.init(s.tables.(model.DB))
+	if got := getResult(s, orphan.Key); got.State != model.BotDied {
+		t.Fatalf("%+v", got)
+	}
+	if got := getResult(s, running.Key); got.State != model.Running {
+		t.Fatalf("%+v", got)
+	}
+	sched.mu.Lock()
+	if len(sched.tasks) != 1 || sched.tasks[pending.Key] == nil || sched.running["bot1"].key != running.Key || len(sched.known) != 2 {
+		t.Fatal(sched.tasks, sched.running, sched.known)
+	}
+	sched.mu.Unlock()
+	// The pending task is still runnable.
+	if got, _ := sched.pollNow(bot3, testNow); got == nil || got.r.Key != pending.Key {
+		t.Fatal(got)
+	}
+	// bot1 polls instead of updating its task, so it lost it.
+	if got, _ := sched.pollNow(bot1, testNow); got != nil {
+		t.Fatal(got)
+	}
+	if got := getResult(s, running.Key); got.State != model.BotDied || got.BotID != "bot1" {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		fairShare string
+		// want is the order in which the tasks start.
+		want []string
+	}{
+		{"", []string{"joe0", "joe1", "joe2", "jane0", "jane1"}},
+		// joe has twice the weight of jane.
+		{"user", []string{"joe0", "jane0", "joe1", "joe2", "jane1"}},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		s.sched.fairShare = l.fairShare
+		s.sched.weights = map[string]float64{"joe": 2}
+		var bots []*model.Bot
+		for j := range l.want {
+			bot := newTestBot(s, fmt.Sprintf("bot%d", j), linux)
+			busyBot(t, s, bot)
+			bots = append(bots, bot)
+		}
+		names := map[int64]string{}
+		for j, u := range []string{"joe", "joe", "joe", "jane", "jane"} {
+			r := testRequest(100, linux)
+			r.User = u
+			r.Created = testNow.Add(time.Duration(j) * time.Second)
+			names[newTestTask(t, s, r).Key] = fmt.Sprintf("%s%d", u, j%3)
+		}
+		var got []string
+		for _, bot := range bots {
+			p, _ := s.sched.pollNow(bot, testNow)
+			if p == nil {
+				t.Fatalf("#%d: no task", i)
+			}
+			got = append(got, names[p.r.Key])
+		}
+		if !reflect.DeepEqual(l.want, got) {
+			t.Errorf("#%d: %v", i, got)
+		}
+	}
+}
+
+func TestShares(t *testing.T) {
+	s := newTestServer(t)
+	s.sched.fairShare = "user"
+	s.sched.weights = map[string]float64{"joe": 2}
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	busyBot(t, s, bot)
+	for _, u := range []string{"joe", "joe", "jane"} {
+		r := testRequest(100, linux)
+		r.User = u
+		newTestTask(t, s, r)
+	}
+	s.sched.pollNow(bot, testNow)
+	want := []messapi.SchedulerShare{
+		{Name: "jane", Weight: 1, Pending: 1},
+		{Name: "joe", Weight: 2, Pending: 1, Running: 1, Share: 0.5},
+	}
+	if got := s.sched.shares(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestPreempt(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		running int32
+		pending int32
+		waited  time.Duration
+		want    bool
+	}{
+		{200, 100, preemptAfter, true},
+		{200, 100, preemptAfter - time.Second, false},
+		{200, 150, preemptAfter, true},
+		// Not important enough.
+		{200, 151, preemptAfter, false},
+		{100, 200, time.Hour, false},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		low := startTestTask(t, s, bot, testRequest(l.running, linux))
+		high := newTestTask(t, s, testRequest(l.pending, linux))
+		now := testNow.Add(l.waited)
+		s.sched.preempt(now)
+		got := getResult(s, low.Key)
+		if !l.want {
+			if got.Killing || got.PreemptedBy != 0 {
+				t.Errorf("#%d: %+v", i, got)
+			}
+			continue
+		}
+		if got.State != model.Running || !got.Killing || got.PreemptedBy != high.Key {
+			t.Errorf("#%d: %+v", i, got)
+		}
+		events, _ := s.tables.BotEventGetSlice("bot1", model.Filter{Limit: 10})
+		if len(events) != 1 || events[0].Event != "task_preempted" || events[0].TaskID != low.Key {
+			t.Errorf("#%d: %+v", i, events)
+		}
+		// The bot is told to stop the task only once.
+		s.sched.preempt(now)
+		if events, _ = s.tables.BotEventGetSlice("bot1", model.Filter{Limit: 10}); len(events) != 1 {
+			t.Errorf("#%d: %+v", i, events)
+		}
+	}
+}
+
+func TestTaskQueues(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	nvidia := map[string][]string{"os": {"Linux"}, "gpu": {"nvidia"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	bot2 := newTestBot(s, "bot2", nvidia)
+	busyBot(t, s, bot1)
+	busyBot(t, s, bot2)
+	for _, d := range []time.Duration{0, time.Minute} {
+		r := testRequest(100, linux)
+		r.Created = testNow.Add(d)
+		newTestTask(t, s, r)
+	}
+	newTestTask(t, s, testRequest(100, nvidia))
+	now := testNow.Add(2 * time.Minute)
+	gpu := messapi.TaskQueue{
+		Dimensions:        []string{"gpu:nvidia", "os:Linux"},
+		ValidUntil:        messapi.CloudTime(testNow.Add(time.Hour)),
+		Pending:           1,
+		OldestPendingSecs: 120,
+		Bots:              1,
+	}
+	cpu := messapi.TaskQueue{
+		Dimensions:        []string{"os:Linux"},
+		ValidUntil:        messapi.CloudTime(testNow.Add(time.Hour + time.Minute)),
+		Pending:           2,
+		OldestPendingSecs: 120,
+		Bots:              2,
+	}
+	got, cursor, err := s.sched.taskQueues("", 10, now)
+	if err != nil || cursor != "" || !reflect.DeepEqual([]messapi.TaskQueue{gpu, cpu}, got) {
+		t.Fatalf("%v %q %+v", err, cursor, got)
+	}
+	// Paginate.
+	if got, cursor, err = s.sched.taskQueues("", 1, now); err != nil || cursor == "" || !reflect.DeepEqual([]messapi.TaskQueue{gpu}, got) {
+		t.Fatalf("%v %q %+v", err, cursor, got)
+	}
+	if got, cursor, err = s.sched.taskQueues(cursor, 1, now); err != nil || cursor != "" || !reflect.DeepEqual([]messapi.TaskQueue{cpu}, got) {
+		t.Fatalf("%v %q %+v", err, cursor, got)
+	}
+	if _, _, err = s.sched.taskQueues("!", 1, now); err == nil {
+		t.Fatal("expected error")
+	}
+	// An empty queue is listed until its tasks would have expired. bot2 runs
+	// the oldest task then the GPU one.
+	s.sched.pollNow(bot2, now)
+	s.sched.pollNow(bot2, now)
+	gpu.Pending = 0
+	gpu.OldestPendingSecs = 0
+	cpu.Pending = 1
+	cpu.OldestPendingSecs = 60
+	if got, _, _ = s.sched.taskQueues("", 10, now); !reflect.DeepEqual([]messapi.TaskQueue{gpu, cpu}, got) {
+		t.Fatalf("%+v", got)
+	}
+	cpu.OldestPendingSecs = 3540
+	if got, _, _ = s.sched.taskQueues("", 10, testNow.Add(time.Hour)); !reflect.DeepEqual([]messapi.TaskQueue{cpu}, got) {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestETA(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	busyBot(t, s, bot)
+	newTask := func(created time.Duration) int64 {
+		r := testRequest(100, linux)
+		r.Created = testNow.Add(created)
+		return newTestTask(t, s, r).Key
+	}
+	a := newTask(0)
+	// No history yet.
+	if _, ok := s.sched.eta(a, testNow); ok {
+		t.Fatal("unexpected estimate")
+	}
+	// a waited 10 minutes.
+	s.sched.pollNow(bot, testNow.Add(10*time.Minute))
+	if _, ok := s.sched.eta(a, testNow.Add(10*time.Minute)); ok {
+		t.Fatal("unexpected estimate for a running task")
+	}
+	b := newTask(9 * time.Minute)
+	c := newTask(11 * time.Minute)
+	data := []struct {
+		key  int64
+		now  time.Duration
+		want time.Duration
+	}{
+		// The tasks usually wait 10 minutes.
+		{b, 10 * time.Minute, 19 * time.Minute},
+		{b, 12 * time.Minute, 19 * time.Minute},
+		{c, 12 * time.Minute, 21 * time.Minute},
+		// Already late.
+		{b, 30 * time.Minute, 30 * time.Minute},
+	}
+	for i, l := range data {
+		if got, ok := s.sched.eta(l.key, testNow.Add(l.now)); !ok || !got.Equal(testNow.Add(l.want)) {
+			t.Errorf("#%d: %t %s", i, ok, got)
+		}
+	}
+	want := messapi.TaskQueueStatsResponse{
+		Dimensions:     []string{"os:Linux"},
+		Pending:        2,
+		Bots:           1,
+		Samples:        1,
+		AvgPendingSecs: 600,
+		EstimatedStart: messapi.CloudTime(testNow.Add(22 * time.Minute)),
+		Now:            messapi.CloudTime(testNow.Add(12 * time.Minute)),
+	}
+	if got, ok := s.sched.queueStats(linux, 100, testNow.Add(12*time.Minute)); !ok || !reflect.DeepEqual(want, got) {
+		t.Fatalf("%+v", got)
+	}
+	if _, ok := s.sched.queueStats(map[string][]string{"os": {"Mac"}}, 100, testNow); ok {
+		t.Fatal("unexpected queue")
+	}
+	// b started 6 minutes after a while the queue was backlogged, so c is
+	// expected to start 6 minutes after b.
+	s.sched.pollNow(bot, testNow.Add(16*time.Minute))
+	if got, ok := s.sched.eta(c, testNow.Add(16*time.Minute)); !ok || !got.Equal(testNow.Add(22*time.Minute)) {
+		t.Fatalf("%t %s", ok, got)
+	}
+}
+
+func TestPreemptWhileCompleting(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	for i := 0; i < 8; i++ {
+		s := newTestServer(t)
+		s.sched.tables = slowTables{s.sched.tables}
+		bot := newTestBot(s, "bot1", linux)
+		s.sched.pollNow(bot, testNow)
+		low := newTestTask(t, s, testRequest(200, linux))
+		if low.State != model.Running {
+			t.Fatalf("#%d: %d", i, low.State)
+		}
+		newTestTask(t, s, testRequest(100, linux))
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.sched.preempt(testNow.Add(preemptAfter))
+		}()
+		go func() {
+			defer wg.Done()
+			// Vary when the task completes while it is being preempted.
+			time.Sleep(time.Duration(i) * 500 * time.Microsecond)
+			s.sched.updateResult(low.Key, func(res *model.TaskResult) bool {
+				if res.State != model.Running {
+					return false
+				}
+				res.State = model.Completed
+				res.Completed = testNow
+				return true
+			})
+		}()
+		wg.Wait()
+		if got := getResult(s, low.Key); got.State != model.Completed {
+			t.Fatalf("#%d: %d", i, got.State)
+		}
+	}
+}
+
+func TestTryNumberAfterPreemption(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	bot2 := newTestBot(s, "bot2", linux)
+	bot3 := newTestBot(s, "bot3", linux)
+	s.sched.pollNow(bot1, testNow)
+	r := testRequest(200, linux)
+	r.TaskSlices[0].Properties.Idempotent = true
+	low := newTestTask(t, s, r)
+	newTestTask(t, s, testRequest(100, linux))
+	now := testNow.Add(preemptAfter)
+	s.sched.preempt(now)
+	// The bot stopped the preempted task.
+	s.sched.updateResult(low.Key, func(res *model.TaskResult) bool {
+		if a := s.sched.requeuePreempted(r, res, now); a != nil {
+			t.Fatal("unexpected assignment")
+		}
+		return true
+	})
+	// The high priority task goes first.
+	if got, _ := s.sched.pollNow(bot1, now); got == nil || got.r.Key == low.Key {
+		t.Fatal(got)
+	}
+	if got, _ := s.sched.pollNow(bot2, now); got == nil || got.r.Key != low.Key {
+		t.Fatal(got)
+	}
+	// bot2 lost the task: it is retried since the preempted run didn't die.
+	_, w := s.sched.pollNow(bot3, now)
+	s.sched.pollNow(bot2, now)
+	if got := <-w.ch; got.r.Key != low.Key {
+		t.Fatal(got)
+	}
+	// bot3 lost it too: it is not retried anymore.
+	s.sched.pollNow(bot3, now)
+	res := getResult(s, low.Key)
+	if res.State != model.BotDied || res.TryNumber != 3 || res.BotID != "bot3" {
+		t.Fatalf("%d %d %s", res.State, res.TryNumber, res.BotID)
+	}
+	want := []struct {
+		try   int32
+		bot   string
+		state model.TaskState
+	}{
+		{1, "bot1", model.Preempted},
+		{2, "bot2", model.BotDied},
+	}
+	if len(res.PreviousRuns) != len(want) {
+		t.Fatal(res.PreviousRuns)
+	}
+	for i, w := range want {
+		if p := res.PreviousRuns[i]; p.TryNumber != w.try || p.BotID != w.bot || p.State != w.state {
+			t.Errorf("#%d: %+v", i, p)
+		}
+	}
+}
+
+func TestNoResource(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	mac := map[string][]string{"os": {"Mac"}}
+	data := []struct {
+		slices []model.TaskSlice
+		dead   bool
+		state  model.TaskState
+		slice  int32
+	}{
+		{[]model.TaskSlice{{Properties: model.TaskProperties{Dimensions: mac}}}, false, model.NoResource, 0},
+		{[]model.TaskSlice{{Properties: model.TaskProperties{Dimensions: linux}}}, false, model.Pending, 0},
+		{[]model.TaskSlice{{Properties: model.TaskProperties{Dimensions: mac}, WaitForCapacity: true}}, false, model.Pending, 0},
+		{[]model.TaskSlice{{Properties: model.TaskProperties{Dimensions: mac}}, {Properties: model.TaskProperties{Dimensions: linux}}}, false, model.Pending, 1},
+		// A dead bot doesn't count.
+		{[]model.TaskSlice{{Properties: model.TaskProperties{Dimensions: linux}}}, true, model.NoResource, 0},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		busyBot(t, s, bot)
+		if l.dead {
+			s.sched.checkDeadBots(testNow.Add(model.DeadAfter + time.Second))
+		}
+		r := testRequest(100, nil)
+		r.TaskSlices = l.slices
+		for j := range r.TaskSlices {
+			r.TaskSlices[j].Properties.Command = []string{"true"}
+			r.TaskSlices[j].Expiration = time.Hour
+		}
+		res := newTestTask(t, s, r)
+		if got := getResult(s, res.Key); got.State != l.state || got.CurrentTaskSlice != l.slice || res.State != l.state {
+			t.Errorf("#%d: %d %d", i, got.State, got.CurrentTaskSlice)
+		}
+	}
+}
+
+func TestNoResourceOnExpiration(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	busyBot(t, s, bot)
+	r := testRequest(100, map[string][]string{"os": {"Mac"}})
+	r.TaskSlices[0].WaitForCapacity = true
+	r.TaskSlices = append(r.TaskSlices, model.TaskSlice{Properties: model.TaskProperties{Command: []string{"true"}, Dimensions: linux}, Expiration: time.Hour})
+	res := newTestTask(t, s, r)
+	// The only bot that could run the next slice died meanwhile.
+	now := testNow.Add(time.Hour)
+	s.sched.checkDeadBots(now)
+	s.sched.expire(now)
+	if got := getResult(s, res.Key); got.State != model.NoResource || !got.Abandoned.Equal(now) {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestBotDiedRetry(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		idempotent bool
+		after      time.Duration
+		retried    bool
+	}{
+		{false, 0, false},
+		{true, 0, true},
+		// The slice expired, it's too late to retry.
+		{true, time.Hour, false},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		r := testRequest(100, linux)
+		r.TaskSlices[0].Properties.Idempotent = l.idempotent
+		res := startTestTask(t, s, bot, r)
+		now := testNow.Add(l.after)
+		if got := s.sched.botDied(res.Key, "bot1", "bot died", now); got != l.retried {
+			t.Fatalf("#%d: %t", i, got)
+		}
+		got := getResult(s, res.Key)
+		if l.retried {
+			if got.State != model.Pending || got.TryNumber != 1 || len(got.PreviousRuns) != 1 || got.PreviousRuns[0].State != model.BotDied {
+				t.Errorf("#%d: %+v", i, got)
+			}
+		} else if got.State != model.BotDied || len(got.PreviousRuns) != 0 || !got.Abandoned.Equal(now) {
+			t.Errorf("#%d: %+v", i, got)
+		}
+		// Another bot can't report the death of the task.
+		if s.sched.botDied(res.Key, "bot2", "bot died", now) {
+			t.Errorf("#%d: retried", i)
+		}
+	}
+}
+
+func TestRetryAvoidsBot(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	bot2 := newTestBot(s, "bot2", linux)
+	// bot2 is known but busy.
+	if _, w := s.sched.pollNow(bot2, testNow); w != nil {
+		s.sched.mu.Lock()
+		s.sched.removeWaitingLocked(w)
+		s.sched.mu.Unlock()
+	}
+	if got, _ := s.sched.pollNow(bot1, testNow); got != nil {
+		t.Fatal(got)
+	}
+	r := testRequest(100, linux)
+	r.TaskSlices[0].Properties.Idempotent = true
+	retried := newTestTask(t, s, r)
+	if retried.BotID != "bot1" {
+		t.Fatal(retried.BotID)
+	}
+	// bot1 lost the task. The retry waits for bot2.
+	got, w := s.sched.pollNow(bot1, testNow)
+	if got != nil || w == nil {
+		t.Fatal(got)
+	}
+	if res := getResult(s, retried.Key); res.State != model.Pending {
+		t.Fatal(res.State)
+	}
+	// bot1 runs the other tasks meanwhile.
+	other := newTestTask(t, s, testRequest(200, linux))
+	if other.BotID != "bot1" {
+		t.Fatal(other.BotID)
+	}
+	if got := <-w.ch; got.r.Key != other.Key {
+		t.Fatal(got.r.Key)
+	}
+	if got, _ = s.sched.pollNow(bot2, testNow); got == nil || got.r.Key != retried.Key {
+		t.Fatal(got)
+	}
+	res := getResult(s, retried.Key)
+	if res.State != model.Running || res.BotID != "bot2" || res.TryNumber != 2 || len(res.PreviousRuns) != 1 || res.PreviousRuns[0].BotID != "bot1" {
+		t.Fatalf("%+v", res)
+	}
+}
+
+func TestRetrySameBot(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot := newTestBot(s, "bot1", linux)
+	s.sched.pollNow(bot, testNow)
+	r := testRequest(100, linux)
+	r.TaskSlices[0].Properties.Idempotent = true
+	res := newTestTask(t, s, r)
+	// No other bot can run the retry.
+	if got, _ := s.sched.pollNow(bot, testNow); got == nil || got.r.Key != res.Key {
+		t.Fatal(got)
+	}
+	if got := getResult(s, res.Key); got.State != model.Running || got.TryNumber != 2 {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestRequeueResetsRun(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	for i, preempted := range []bool{false, true} {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		s.sched.pollNow(bot, testNow)
+		r := testRequest(100, linux)
+		r.TaskSlices[0].Properties.Idempotent = true
+		res := newTestTask(t, s, r)
+		// The run reported some progress.
+		if err := s.outputs.SetOutput(res.Key, 0, []byte("first run")); err != nil {
+			t.Fatal(err)
+		}
+		s.sched.updateResult(res.Key, func(res *model.TaskResult) bool {
+			res.TaskOutput.Size = 9
+			res.Cost = 0.1
+			res.CIPDPins = []model.CIPDPackage{{PkgName: "pkg", Version: "1"}}
+			res.Perf.BotOverhead = time.Second
+			res.Duration = time.Minute
+			return true
+		})
+		if preempted {
+			s.sched.updateResult(res.Key, func(res *model.TaskResult) bool {
+				s.sched.requeuePreempted(r, res, testNow)
+				return true
+			})
+		} else {
+			// The bot lost the task.
+			s.sched.pollNow(bot, testNow)
+		}
+		got := getResult(s, res.Key)
+		if got.TaskOutput.Size != 0 || got.Cost != 0 || got.CIPDPins != nil || got.Perf.BotOverhead != 0 || got.Duration != 0 {
+			t.Errorf("#%d: %+v", i, got)
+		}
+		if out, _ := s.outputs.ReadOutput(res.Key, 0, 100); len(out) != 0 {
+			t.Errorf("#%d: %q", i, out)
+		}
+	}
+}
+
+func newTestScheduler(t *testing.T) *scheduler {
+	d, err := model.NewDBJSON(filepath.Join(t.TempDir(), "db.json.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	s := &scheduler{}
+	s.init(d)
+	return s
+}
+
+// testNow is the fixed current time of the scheduler tests.
+var testNow = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newTestServer returns a server with an in-memory DB, whose scheduler clock
+// is fixed at testNow.
+func newTestServer(t *testing.T) *server {
+	d, err := model.NewDBJSON("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := model.NewTaskOutputs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{version: "test", tables: d, outputs: outputs, authCache: map[string]*userInfo{}}
+	if s.botAuth, err = newBotAuthenticator(&config{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.groups, err = newBotGroups(nil); err != nil {
+		t.Fatal(err)
+	}
+	s.sched.clock = func() time.Time { return testNow }
+	s.sched.outputs = outputs
+	s.sched.newTask = s.newTask
+	s.sched.init(d)
+	return s
+}
+
+// testRequest returns a task request created at testNow with a single slice
+// for the bots having these dimensions.
+func testRequest(priority int32, dims map[string][]string) *model.TaskRequest {
+	return &model.TaskRequest{
+		SchemaVersion: 1,
+		Created:       testNow,
+		Priority:      priority,
+		TaskSlices: []model.TaskSlice{
+			{Properties: model.TaskProperties{Command: []string{"true"}, Dimensions: dims}, Expiration: time.Hour},
+		},
+	}
+}
+
+// newTestTask creates a task and returns its TaskResult.
+func newTestTask(t *testing.T, s *server, r *model.TaskRequest) *model.TaskResult {
+	res, err := s.newTask(context.Background(), r, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// newTestBot saves a bot with these dimensions, seen at testNow.
+func newTestBot(s *server, id string, dims map[string][]string) *model.Bot {
+	d := map[string][]string{"id": {id}}
+	for k, v := range dims {
+		d[k] = v
+	}
+	b := &model.Bot{Key: id, SchemaVersion: 1, Created: testNow, LastSeen: testNow, Version: "v1", Dimensions: d}
+	s.tables.BotSet(b)
+	return b
+}
+
+// busyBot makes a bot known to the scheduler without waiting for a task, as if
+// it was running something else.
+func busyBot(t *testing.T, s *server, bot *model.Bot) {
+	got, w := s.sched.pollNow(bot, testNow)
+	if got != nil {
+		t.Fatalf("unexpected task %d", got.r.Key)
+	}
+	s.sched.mu.Lock()
+	s.sched.removeWaitingLocked(w)
+	s.sched.mu.Unlock()
+}
+
+// getResult returns the saved TaskResult of a task.
+func getResult(s *server, key int64) model.TaskResult {
+	res := model.TaskResult{}
+	s.tables.TaskResultGet(key, &res)
+	return res
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+	"github.com/maruel/mess/messapi"
+)
+
+// simWorkload is a recorded workload replayed by the scheduler simulator.
+//
+// It can be recorded from a server's DB with -record-workload, or written by
+// hand to evaluate a specific scenario.
+type simWorkload struct {
+	Bots  []simBot  `json:"bots"`
+	Tasks []simTask `json:"tasks"`
+}
+
+// simBot is a bot of the simulated fleet.
+type simBot struct {
+	ID         string              `json:"id"`
+	Dimensions map[string][]string `json:"dimensions"`
+	// Join is when the bot starts polling, in seconds since the start of the
+	// simulation.
+	Join float64 `json:"join,omitempty"`
+}
+
+// simTask is a task created during the simulation.
+type simTask struct {
+	// At is when the task is created, in seconds since the start of the
+	// simulation.
+	At float64 `json:"at"`
+	// Duration is how long the task runs once started, in seconds.
+	Duration float64                 `json:"duration"`
+	Request  messapi.TasksNewRequest `json:"request"`
+}
+
+// loadWorkload loads a workload file.
+func loadWorkload(path string) (*simWorkload, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	wl := &simWorkload{}
+	if err = d.Decode(wl); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return wl, nil
+}
+
+// saveWorkload saves a workload file.
+func saveWorkload(path string, wl *simWorkload) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(f)
+	e.SetIndent("", " ")
+	if err = e.Encode(wl); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// simStart is the virtual time the simulations start at. It is fixed so the
+// results are reproducible.
+var simStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// simTick is how often the simulated scheduler loop runs, like scheduler.loop.
+const simTick = 10 * time.Second
+
+// simulator replays a workload against a scheduler with a virtual clock.
+//
+// Everything runs on a single goroutine and the scheduler doesn't depend on
+// the map iteration order, so a simulation is deterministic.
+type simulator struct {
+	srv     server
+	now     time.Time
+	runners []*simRunner
+	// durations is how long each task runs once started, keyed by task key.
+	durations map[int64]time.Duration
+	// preempted is the number of runs preempted, keyed by task key.
+	preempted map[int64]int
+}
+
+// simRunner is a simulated bot.
+type simRunner struct {
+	bot    *model.Bot
+	joined time.Time
+	// w is set while the bot is waiting for a task.
+	w *waitingBot
+	// t is the running task, if any, which completes at done.
+	t       *model.TaskRequest
+	started time.Time
+	done    time.Time
+	busy    time.Duration
+}
+
+// simulate replays a workload and writes the report to out.
+//
+// The scheduler policy is the one of the server: -fair-share and quotas.
+func simulate(wl *simWorkload, fairShare string, weights map[string]float64, quotas []quota, out io.Writer) error {
+	// The DB is kept in memory and never saved.
+	d, err := model.NewDBJSON("")
+	if err != nil {
+		return err
+	}
+	sim := &simulator{
+		now:       simStart,
+		durations: map[int64]time.Duration{},
+		preempted: map[int64]int{},
+	}
+	sim.srv = server{version: "simulator", tables: d}
+	sim.srv.sched.fairShare = fairShare
+	sim.srv.sched.weights = weights
+	for i := range quotas {
+		sim.srv.sched.quotas = append(sim.srv.sched.quotas, &quotaState{quota: quotas[i]})
+	}
+	sim.srv.sched.clock = func() time.Time { return sim.now }
+	sim.srv.sched.newTask = sim.srv.newTask
+	sim.srv.sched.init(d)
+
+	tasks := make([]simTask, len(wl.Tasks))
+	copy(tasks, wl.Tasks)
+	sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].At < tasks[j].At })
+	bots := make([]simBot, len(wl.Bots))
+	copy(bots, wl.Bots)
+	sort.SliceStable(bots, func(i, j int) bool {
+		if bots[i].Join != bots[j].Join {
+			return bots[i].Join < bots[j].Join
+		}
+		return bots[i].ID < bots[j].ID
+	})
+
+	ctx := context.Background()
+	// Keys of the created tasks, and priorities of the rejected ones.
+	var created []int64
+	var rejected []int32
+	nextTick := simStart.Add(simTick)
+	for ti, bi := 0, 0; ; {
+		next := nextTick
+		if ti < len(tasks) {
+			if t := simTime(tasks[ti].At); t.Before(next) {
+				next = t
+			}
+		}
+		if bi < len(bots) {
+			if t := simTime(bots[bi].Join); t.Before(next) {
+				next = t
+			}
+		}
+		running := false
+		for _, r := range sim.runners {
+			if r.t != nil {
+				running = true
+				if r.done.Before(next) {
+					next = r.done
+				}
+			}
+		}
+		if ti == len(tasks) && bi == len(bots) && !running && len(sim.srv.sched.tasks) == 0 {
+			break
+		}
+		sim.now = next
+
+		for _, r := range sim.runners {
+			if r.t != nil && !r.done.After(sim.now) {
+				sim.complete(r)
+			}
+		}
+		for ; bi < len(bots) && !simTime(bots[bi].Join).After(sim.now); bi++ {
+			b := &model.Bot{
+				Key:           bots[bi].ID,
+				SchemaVersion: 1,
+				Created:       sim.now,
+				LastSeen:      sim.now,
+				Version:       "simulator",
+				Dimensions:    bots[bi].Dimensions,
+			}
+			d.BotSet(b)
+			r := &simRunner{bot: b, joined: sim.now}
+			sim.runners = append(sim.runners, r)
+			sort.Slice(sim.runners, func(i, j int) bool { return sim.runners[i].bot.Key < sim.runners[j].bot.Key })
+			sim.poll(r)
+		}
+		for ; ti < len(tasks) && !simTime(tasks[ti].At).After(sim.now); ti++ {
+			m := &model.TaskRequest{SchemaVersion: 1}
+			if err := tasks[ti].Request.ToDB(sim.now, m); err != nil {
+				return fmt.Errorf("task #%d: %w", ti, err)
+			}
+			if _, err := sim.srv.newTask(ctx, m, sim.now); err != nil {
+				if errors.Is(err, errQuota) {
+					rejected = append(rejected, m.Priority)
+					continue
+				}
+				return fmt.Errorf("task #%d: %w", ti, err)
+			}
+			created = append(created, m.Key)
+			sim.durations[m.Key] = time.Duration(tasks[ti].Duration * float64(time.Second))
+			sim.collect()
+		}
+		if !sim.now.Before(nextTick) {
+			sim.tick()
+			nextTick = nextTick.Add(simTick)
+		}
+		sim.collect()
+	}
+	sim.report(created, rejected, out)
+	return nil
+}
+
+// poll makes an idle bot poll for a task.
+func (sim *simulator) poll(r *simRunner) {
+	t, w := sim.srv.sched.pollNow(r.bot, sim.now)
+	if t != nil {
+		sim.run(r, t)
+		return
+	}
+	r.w = w
+}
+
+// collect starts the tasks that were assigned to the waiting bots.
+func (sim *simulator) collect() {
+	for _, r := range sim.runners {
+		if r.w == nil {
+			continue
+		}
+		select {
+		case t := <-r.w.ch:
+			r.w = nil
+			sim.run(r, t)
+		default:
+		}
+	}
+}
+
+func (sim *simulator) run(r *simRunner, t *pendingTask) {
+	r.t = t.r
+	r.started = sim.now
+	d := sim.durations[t.r.Key]
+	if h := t.r.TaskSlices[t.slice].Properties.HardTimeout; h != 0 && d > h {
+		d = h
+	}
+	r.done = sim.now.Add(d)
+}
+
+// complete saves that the task of a bot completed and makes the bot poll again.
+func (sim *simulator) complete(r *simRunner) {
+	sim.srv.sched.updateResult(r.t.Key, func(res *model.TaskResult) bool {
+		if res.State != model.Running || res.BotID != r.bot.Key {
+			return false
+		}
+		res.State = model.Completed
+		p := &r.t.TaskSlices[res.CurrentTaskSlice].Properties
+		if p.HardTimeout != 0 && sim.durations[r.t.Key] > p.HardTimeout {
+			res.State = model.Timedout
+		}
+		res.Duration = sim.now.Sub(r.started)
+		res.Completed = sim.now
+		res.Modified = sim.now
+		sim.srv.sched.cachesInstalled(r.bot.Key, p.Caches)
+		return true
+	})
+	r.busy += sim.now.Sub(r.started)
+	r.t = nil
+	sim.poll(r)
+}
+
+// tick runs the periodic part of scheduler.loop.
+//
+// The bots stop the preempted tasks right away instead of on their next
+// task_update.
+func (sim *simulator) tick() {
+	s := &sim.srv.sched
+	s.runSchedules(context.Background(), sim.now)
+	s.expire(sim.now)
+	s.dispatch(sim.now)
+	s.preempt(sim.now)
+	for _, r := range sim.runners {
+		if r.t == nil {
+			continue
+		}
+		var a *assignment
+		stopped := false
+		s.updateResult(r.t.Key, func(res *model.TaskResult) bool {
+			if res.State != model.Running || res.BotID != r.bot.Key || !res.Killing || res.PreemptedBy == 0 {
+				return false
+			}
+			a = s.requeuePreempted(r.t, res, sim.now)
+			stopped = true
+			return true
+		})
+		if !stopped {
+			continue
+		}
+		if a != nil {
+			s.send(a, sim.now)
+		}
+		sim.preempted[r.t.Key]++
+		r.busy += sim.now.Sub(r.started)
+		r.t = nil
+		sim.poll(r)
+	}
+}
+
+// simPriority is the statistics of the tasks of a priority.
+type simPriority struct {
+	tasks     int
+	rejected  int
+	starved   int
+	preempted int
+	latencies []time.Duration
+}
+
+// report writes the pending latency percentiles and starvation per priority,
+// and the bots utilization.
+func (sim *simulator) report(created []int64, rejected []int32, out io.Writer) {
+	prios := map[int32]*simPriority{}
+	get := func(p int32) *simPriority {
+		if prios[p] == nil {
+			prios[p] = &simPriority{}
+		}
+		return prios[p]
+	}
+	for _, p := range rejected {
+		get(p).rejected++
+	}
+	all := &simPriority{rejected: len(rejected)}
+	r := model.TaskRequest{}
+	res := model.TaskResult{}
+	for _, key := range created {
+		sim.srv.tables.TaskRequestGet(key, &r)
+		sim.srv.tables.TaskResultGet(key, &res)
+		for _, p := range []*simPriority{get(r.Priority), all} {
+			p.tasks++
+			p.preempted += sim.preempted[key]
+			started := res.Started
+			if len(res.PreviousRuns) != 0 {
+				started = res.PreviousRuns[0].Started
+			}
+			if res.DedupedFrom != 0 {
+				p.latencies = append(p.latencies, 0)
+			} else if started.IsZero() {
+				p.starved++
+			} else {
+				p.latencies = append(p.latencies, started.Sub(r.Created))
+			}
+		}
+	}
+	keys := make([]int32, 0, len(prios))
+	for p := range prios {
+		keys = append(keys, p)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	end := sim.now
+	fmt.Fprintf(out, "Simulated %s with %d bots and %d tasks.\n\n", end.Sub(simStart), len(sim.runners), all.tasks+all.rejected)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "Priority\tTasks\tRejected\tStarved\tPreempted\tP50\tP90\tP99\tMax\t\n")
+	line := func(name string, p *simPriority) {
+		sort.Slice(p.latencies, func(i, j int) bool { return p.latencies[i] < p.latencies[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t\n", name, p.tasks, p.rejected, p.starved, p.preempted,
+			percentile(p.latencies, 0.5), percentile(p.latencies, 0.9), percentile(p.latencies, 0.99), percentile(p.latencies, 1))
+	}
+	for _, k := range keys {
+		line(fmt.Sprintf("%d", k), prios[k])
+	}
+	line("All", all)
+	w.Flush()
+
+	var busy, available time.Duration
+	minUse, maxUse := math.Inf(1), math.Inf(-1)
+	for _, r := range sim.runners {
+		a := end.Sub(r.joined)
+		busy += r.busy
+		available += a
+		if a > 0 {
+			u := float64(r.busy) / float64(a)
+			minUse = math.Min(minUse, u)
+			maxUse = math.Max(maxUse, u)
+		}
+	}
+	if available > 0 {
+		fmt.Fprintf(out, "\nBot utilization: %.1f%% (min %.1f%%, max %.1f%%)\n", 100*float64(busy)/float64(available), 100*minUse, 100*maxUse)
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted durations.
+func percentile(l []time.Duration, p float64) string {
+	if len(l) == 0 {
+		return "-"
+	}
+	i := int(math.Ceil(p*float64(len(l)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return l[i].Round(time.Second).String()
+}
+
+// simTime converts an offset in seconds to the virtual time.
+func simTime(secs float64) time.Time {
+	return simStart.Add(time.Duration(secs * float64(time.Second)))
+}
+
+// recordWorkload records the tasks and bots in a DB as a workload for the
+// simulator.
+func recordWorkload(db model.Tables) *simWorkload {
+	wl := &simWorkload{}
+	bots, _ := db.BotGetSlice("", 100000)
+	for i := range bots {
+		if !bots[i].Deleted {
+			wl.Bots = append(wl.Bots, simBot{ID: bots[i].Key, Dimensions: bots[i].Dimensions})
+		}
+	}
+	reqs, _ := db.TaskRequestSlice(model.Filter{Limit: 1000000})
+	sort.Slice(reqs, func(i, j int) bool {
+		if !reqs[i].Created.Equal(reqs[j].Created) {
+			return reqs[i].Created.Before(reqs[j].Created)
+		}
+		return reqs[i].Key < reqs[j].Key
+	})
+	res := model.TaskResult{}
+	for i := range reqs {
+		m := &reqs[i]
+		res = model.TaskResult{}
+		db.TaskResultGet(m.Key, &res)
+		d := res.Duration
+		if d == 0 && !res.Started.IsZero() && !res.Completed.IsZero() {
+			d = res.Completed.Sub(res.Started)
+		}
+		r := messapi.TaskRequest{}
+		r.FromDB(m)
+		wl.Tasks = append(wl.Tasks, simTask{
+			At:       m.Created.Sub(reqs[0].Created).Seconds(),
+			Duration: d.Seconds(),
+			Request: messapi.TasksNewRequest{
+				Name:           r.Name,
+				Priority:       r.Priority,
+				TaskSlices:     r.TaskSlices,
+				Tags:           r.Tags,
+				User:           r.User,
+				ServiceAccount: r.ServiceAccount,
+				Realm:          r.Realm,
+			},
+		})
+	}
+	return wl
+}
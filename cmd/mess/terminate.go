@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+// terminateTag marks the special task asking a bot to terminate, like Swarming.
+const terminateTag = "swarming.terminate:1"
+
+// newTerminateTask returns the special task asking a bot to terminate.
+//
+// It has no command and only the bot can run it, once done with its current
+// task. The bot shuts down instead of running it and reports it as completed.
+func newTerminateTask(botID string, now time.Time) *model.TaskRequest {
+	return &model.TaskRequest{
+		SchemaVersion: 1,
+		Created:       now,
+		Name:          "Terminate " + botID,
+		// The highest priority.
+		Priority: 1,
+		Tags:     []string{terminateTag},
+		TaskSlices: []model.TaskSlice{
+			{
+				Properties: model.TaskProperties{
+					Dimensions: map[string][]string{"id": {botID}},
+				},
+				Expiration: 3 * 24 * time.Hour,
+				// Wait for the bot even if it is not known yet, e.g. after a server
+				// restart.
+				WaitForCapacity: true,
+			},
+		},
+	}
+}
+
+// isTerminateTask returns true if the task is a special task created by
+// newTerminateTask.
+func isTerminateTask(r *model.TaskRequest) bool {
+	if len(r.TaskSlices) != 1 || len(r.TaskSlices[0].Properties.Command) != 0 {
+		return false
+	}
+	for _, t := range r.Tags {
+		if t == terminateTag {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,6 +31,11 @@ type server struct {
 	version string
 	cid     string
 	allowed map[string]struct{}
+	// bootstrappers are the users that can get bootstrap tokens.
+	bootstrappers map[string]struct{}
+	botAuth       *botAuthenticator
+	tls           *tls.Config
+	groups        *botGroups
 
 	tables  model.Tables
 	outputs *model.TaskOutputs
@@ -52,6 +58,9 @@ func (s *server) start(port int) error {
 	} else {
 		s.l, err = net.Listen("tcp", suffix)
 	}
+	if err == nil && s.tls != nil {
+		s.l = tls.NewListener(s.l, s.tls)
+	}
 	return err
 }
 
@@ -209,7 +218,7 @@ func (s *server) serve(ctx context.Context) {
 		Handler:     wrapLog(&mux),
 		ReadTimeout: time.Minute,
 		IdleTimeout: 10 * time.Minute,
-		// TODO(maruel): TLSConfig: tlscfg,
+		// TLS is handled by the listener, see start().
 	}
 	go w.Serve(s.l)
 }
@@ -312,6 +321,9 @@ func getURL(req *http.Request) string {
 	scheme := req.URL.Scheme
 	if scheme == "" {
 		scheme = "http:"
+		if req.TLS != nil {
+			scheme = "https:"
+		}
 	}
 	return scheme + "//" + host
 }
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"compress/zlib"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -16,11 +21,14 @@ import (
 )
 
 func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
-	if !isLocal(r) {
-		sendJSONResponse(w, errorStatus{status: 403})
+	ctx := r.Context()
+	now := time.Now()
+	ident, err := s.botAuth.authenticate(r, now)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("bot authentication")
+		sendJSONResponse(w, errorStatus{status: 403, err: err})
 		return
 	}
-	ctx := r.Context()
 
 	// Non-API URLs.
 	h := w.Header()
@@ -29,16 +37,15 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Server Up"))
 		return
 	}
-	if r.URL.Path == "/bot_code" {
-		version := internal.GetBotVersion(ctx, getURL(r))
-		http.Redirect(w, r, "/swarming/api/v1/bot/bot_code/"+version, http.StatusFound)
-		return
-	}
 	if strings.HasPrefix(r.URL.Path, "/bot_code") {
 		version := internal.GetBotVersion(ctx, getURL(r))
-		if r.URL.Path[len("/bot_code/"):] != version {
-			// It happens...
-			http.Redirect(w, r, "/swarming/api/v1/bot/bot_code/"+version, http.StatusFound)
+		if r.URL.Path != "/bot_code/"+version {
+			// It happens... Keep the bootstrap token, if any.
+			u := "/swarming/api/v1/bot/bot_code/" + version
+			if r.URL.RawQuery != "" {
+				u += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, u, http.StatusFound)
 			return
 		}
 		if r.Method != "GET" && r.Method != "HEAD" {
@@ -52,9 +59,16 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Bootstrap tokens are only meant to download the bot code. The bot must
+	// then authenticate with another credential, e.g. a secret returned by
+	// get_authentication_headers() in bot_config.py.
+	if ident.method == "token" {
+		sendJSONResponse(w, errorStatus{status: 403, err: errors.New("bootstrap tokens can only download the bot code")})
+		return
+	}
+
 	// All other endpoints are bot APIs expecting a JSON response.
 	id := r.Header.Get("X-Luci-Swarming-Bot-ID")
-	now := time.Now()
 	// canary, _ := r.Cookie("GOOGAPPUID")
 
 	if r.Method != "POST" {
@@ -95,13 +109,40 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 
 	bot := model.Bot{Key: id, Created: now}
 	s.tables.BotGet(id, &bot)
+	// A bot keeps the identity it first authenticated with, so another bot
+	// cannot impersonate it with different credentials, even on handshake. The
+	// binding is only reset once the bot is dead, e.g. when an admin deleted it.
+	if bot.AuthenticatedAs != "" && bot.AuthenticatedAs != ident.name && !bot.Dead && !bot.Deleted {
+		log.Ctx(ctx).Warn().Str("want", bot.AuthenticatedAs).Str("got", ident.name).Msg("bot identity mismatch")
+		sendJSONResponse(w, errorStatus{status: 403, err: fmt.Errorf("bot is authenticated as %q", bot.AuthenticatedAs)})
+		return
+	}
 	bot.LastSeen = now
+	// The scheduler may have marked it as dead but it is back.
+	bot.Dead = false
 	if bcr.Version != "" {
 		bot.Version = bcr.Version
 	}
+	grp := s.groups.match(id)
+	if grp == nil && len(s.groups.groups) != 0 {
+		sendJSONResponse(w, errorStatus{status: 403, err: errors.New("bot is not in any bot group")})
+		return
+	}
+	if grp != nil && !grp.allowsAuth(ident.method) {
+		sendJSONResponse(w, errorStatus{status: 403, err: fmt.Errorf("bot group doesn't allow %s authentication", ident.method)})
+		return
+	}
 	if len(bcr.Dimensions) != 0 {
 		bot.Dimensions = bcr.Dimensions
+		if grp != nil {
+			bot.Dimensions = grp.inject(bot.Dimensions)
+		}
+	}
+	if !ident.allows(bot.Dimensions) {
+		sendJSONResponse(w, errorStatus{status: 403, err: fmt.Errorf("%s can only be in pool %q", ident.name, ident.pool)})
+		return
 	}
+	bot.AuthenticatedAs = ident.name
 	bot.ExternalIP = getRemoteIP(r)
 	if len(bcr.State) != 0 {
 		if s, err := json.Marshal(bcr.State); err == nil {
@@ -125,15 +166,22 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 		}
 		data := botHandshakeResponse{
 			BotVersion:         internal.GetBotVersion(ctx, getURL(r)),
-			BotConfigRev:       "??",
+			BotConfigRev:       internal.GetBotConfigRev(),
 			BotConfigName:      "bot_config.py",
 			ServerVersion:      s.version,
-			BotGroupCfgVersion: "??",
+			BotGroupCfgVersion: s.groups.rev,
 			BotGroupCfg: botGroupCfg{
 				Dimensions: []messapi.StringListPair{},
 			},
 		}
-		// TODO(maruel): Inject server-side bot config and dimensions.
+		if grp != nil {
+			data.BotGroupCfg.Dimensions = messapi.ToStringListPairs(grp.dimensions())
+			if grp.script != nil {
+				data.BotConfig = string(grp.script)
+				data.BotConfigRev = grp.scriptRev
+				data.BotConfigName = filepath.Base(grp.BotConfig)
+			}
+		}
 		sendJSONResponse(w, data)
 		return
 	}
@@ -184,40 +232,66 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 			sendJSONResponse(w, errorStatus{status: 400, err: err})
 			return
 		}
-		// TODO(maruel): Enforce server-side known bot-task mapping.
 		id := model.FromTaskID(btr.TaskID)
 		if id == 0 {
 			sendJSONResponse(w, errorStatus{status: 400, err: errors.New("bad task id")})
 			return
 		}
-		_ = s.outputs.SetOutput(id, btr.OutputChunkStart, btr.Output)
-		obj := model.TaskResult{}
-		s.tables.TaskResultGet(id, &obj)
-		if btr.DurationSecs != 0 {
-			e := model.BotEvent{}
-			e.InitFrom(&bot, now, "task_completed", string(btr.TaskID))
-			s.tables.BotEventAdd(&e)
-			if btr.HardTimeout || btr.IOTimeout {
-				obj.State = model.Timedout
-			} else {
-				obj.State = model.Completed
+		var err error
+		var a *assignment
+		mustStop := false
+		s.sched.updateResult(id, func(obj *model.TaskResult) bool {
+			if err = s.checkBotTask(&bot, id, obj, now); err != nil {
+				return false
 			}
-			obj.ExitCode = btr.ExitCode
-			obj.Duration = time.Duration(btr.DurationSecs * float64(time.Second)).Round(time.Millisecond)
-			/*
-				BotOverheadSecs  float64     `json:"bot_overhead"`
-				CacheTrimStats   interface{} `json:"cache_trim_stats"`
-				CASOutputRoot    interface{} `json:"cas_output_root"`
-				CIPDPins         interface{} `json:"cipd_pins"`
-				CIPDStats        interface{} `json:"cipd_stats"`
-				CleanupStats     interface{} `json:"cleanup_stats"`
-				CostUSD          float64     `json:"cost_usd"`
-				IsolatedStats    interface{} `json:"isolated_stats"`
-				NamedCachesStats interface{} `json:"named_caches_stats"`
-			*/
-			s.tables.TaskResultSet(&obj)
+			_ = s.outputs.SetOutput(id, btr.OutputChunkStart, btr.Output)
+			if err = btr.toDB(obj); err != nil {
+				return false
+			}
+			obj.Modified = now
+			if btr.ExitCode != nil {
+				e := model.BotEvent{}
+				e.InitFrom(&bot, now, "task_completed", string(btr.TaskID))
+				s.tables.BotEventAdd(&e)
+				bot.TaskID = 0
+				s.tables.BotSet(&bot)
+				req := model.TaskRequest{}
+				s.tables.TaskRequestGet(id, &req)
+				if int(obj.CurrentTaskSlice) < len(req.TaskSlices) {
+					s.sched.cachesInstalled(bot.Key, req.TaskSlices[obj.CurrentTaskSlice].Properties.Caches)
+				}
+				if obj.Killing && obj.PreemptedBy != 0 {
+					// The bot stopped the task to run one with a higher priority.
+					a = s.sched.requeuePreempted(&req, obj, now)
+					return true
+				}
+				switch {
+				case obj.Killing:
+					// The task was canceled while running, even if the bot didn't
+					// start it yet.
+					obj.State = model.Killed
+				case btr.Canceled:
+					obj.State = model.Canceled
+				case btr.HardTimeout || btr.IOTimeout:
+					obj.State = model.Timedout
+				default:
+					obj.State = model.Completed
+				}
+				obj.ExitCode = *btr.ExitCode
+				obj.Duration = fromSecs(btr.DurationSecs)
+				obj.Completed = now
+			}
+			mustStop = obj.Killing
+			return true
+		})
+		if err != nil {
+			sendJSONResponse(w, errorStatus{status: 400, err: err})
+			return
+		}
+		if a != nil {
+			s.sched.send(a, now)
 		}
-		sendJSONResponse(w, botTaskUpdateResponse{Ok: true})
+		sendJSONResponse(w, botTaskUpdateResponse{Ok: true, MustStop: mustStop})
 		return
 	}
 	if r.URL.Path == "/task_error" || strings.HasPrefix(r.URL.Path, "/task_error/") {
@@ -227,9 +301,29 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 			sendJSONResponse(w, errorStatus{status: 400, err: err})
 			return
 		}
+		id := model.FromTaskID(model.TaskID(btr.TaskID))
+		if id == 0 {
+			sendJSONResponse(w, errorStatus{status: 400, err: errors.New("bad task id")})
+			return
+		}
+		obj := model.TaskResult{}
+		s.tables.TaskResultGet(id, &obj)
+		if err := s.checkBotTask(&bot, id, &obj, now); err != nil {
+			sendJSONResponse(w, errorStatus{status: 400, err: err})
+			return
+		}
 		e := model.BotEvent{}
 		e.InitFrom(&bot, now, "task_error", btr.Message)
+		e.TaskID = id
 		s.tables.BotEventAdd(&e)
+		bot.TaskID = 0
+		s.tables.BotSet(&bot)
+		// The bot failed to run the task, like if it died.
+		failure := btr.Message
+		if failure == "" {
+			failure = "task error"
+		}
+		s.sched.botDied(id, bot.Key, failure, now)
 		sendJSONResponse(w, map[string]string{})
 		return
 	}
@@ -237,6 +331,28 @@ func (s *server) apiBot(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, errorStatus{status: 404, err: errUnknownAPI})
 }
 
+// checkBotTask returns an error if a task is not running on this bot, e.g. it
+// was assigned to another bot or it already completed. The violation is logged
+// as a bot_error BotEvent.
+func (s *server) checkBotTask(bot *model.Bot, id int64, res *model.TaskResult, now time.Time) error {
+	var err error
+	switch {
+	case res.Key == 0:
+		err = fmt.Errorf("unknown task %s", model.ToTaskID(id))
+	case res.State != model.Running:
+		err = fmt.Errorf("task %s is not running", model.ToTaskID(id))
+	case res.BotID != bot.Key || bot.TaskID != id:
+		err = fmt.Errorf("task %s is not assigned to this bot", model.ToTaskID(id))
+	default:
+		return nil
+	}
+	e := model.BotEvent{}
+	e.InitFrom(bot, now, "bot_error", err.Error())
+	e.TaskID = id
+	s.tables.BotEventAdd(&e)
+	return err
+}
+
 func (s *server) apiBotPoll(w http.ResponseWriter, r *http.Request, now time.Time, id string, bot *model.Bot, raw []byte) {
 	bpr := botPollRequest{}
 	if err := decodeJSONStrict(raw, &bpr); err != nil {
@@ -255,17 +371,56 @@ func (s *server) apiBotPoll(w http.ResponseWriter, r *http.Request, now time.Tim
 		return
 	}
 
-	task := s.sched.poll(ctx, bot)
+	// The bot reports the bot group configuration it got on handshake.
+	if v, _ := bpr.State["bot_group_cfg_version"].(string); v != "" && v != s.groups.rev && bot.RestartMsg == "" {
+		bot.RestartMsg = "Restarting to pick up new bot group configuration"
+	}
+	if bot.RestartMsg != "" {
+		bp.Cmd = "bot_restart"
+		bp.Message = bot.RestartMsg
+		bot.RestartMsg = ""
+		s.tables.BotSet(bot)
+		e := model.BotEvent{}
+		e.InitFrom(bot, now, "request_restart", bp.Message)
+		s.tables.BotEventAdd(&e)
+		sendJSONResponse(w, bp)
+		return
+	}
+
+	if bot.TaskID != 0 {
+		// The bot is done with its previous task.
+		bot.TaskID = 0
+		s.tables.BotSet(bot)
+	}
+	task, slice := s.sched.poll(ctx, bot)
+	if task != nil {
+		// The poll may have waited for a while. Reload the bot so the fields
+		// updated meanwhile, like a RestartMsg set by an admin, are not
+		// overwritten.
+		b := model.Bot{}
+		s.tables.BotGet(bot.Key, &b)
+		b.TaskID = task.Key
+		s.tables.BotSet(&b)
+		*bot = b
+	}
+	if task != nil && isTerminateTask(task) {
+		bp.Cmd = "terminate"
+		bp.TaskID = string(model.ToTaskID(task.Key))
+		e := model.BotEvent{}
+		e.InitFrom(bot, now, "bot_terminate", bp.TaskID)
+		s.tables.BotEventAdd(&e)
+		sendJSONResponse(w, bp)
+		return
+	}
 	if task != nil {
 		bp.Cmd = "run"
-		bp.Manifest.fromRequest(task, 0)
+		bp.Manifest.fromRequest(task, slice, s.sched.cacheHints(task.TaskSlices[slice].Properties.Caches))
 		bp.Manifest.BotID = bot.Key
 		bp.Manifest.BotAuthenticatedAs = bot.AuthenticatedAs
 		bp.Manifest.Host = getURL(r)
 		sendJSONResponse(w, bp)
 		return
 	}
-	// TODO(maruel): bot_restart, terminate.
 	bp.Cmd = "sleep"
 	bp.Duration = 10
 	sendJSONResponse(w, bp)
@@ -288,6 +443,7 @@ type botHandshakeRequest struct {
 // botHandshakeResponse is response to /swarming/api/v1/bot/handshake.
 type botHandshakeResponse struct {
 	BotVersion         string      `json:"bot_version"`
+	BotConfig          string      `json:"bot_config,omitempty"`
 	BotConfigRev       string      `json:"bot_config_rev"`
 	BotConfigName      string      `json:"bot_config_name"`
 	ServerVersion      string      `json:"server_version"`
@@ -350,13 +506,13 @@ type botPollManifest struct {
 	TaskID             model.TaskID             `json:"task_id"`
 }
 
-func (b *botPollManifest) fromRequest(t *model.TaskRequest, slice int) {
+func (b *botPollManifest) fromRequest(t *model.TaskRequest, slice int, hints []int64) {
 	p := &t.TaskSlices[slice].Properties
 	b.Caches = make([]botPollCache, len(p.Caches))
 	for i := range p.Caches {
 		b.Caches[i].Name = p.Caches[i].Name
 		b.Caches[i].Path = p.Caches[i].Path
-		b.Caches[i].Hint = 0 // TODO(maruel): Calculate.
+		b.Caches[i].Hint = hints[i]
 	}
 	b.CIPDInput.ClientPackage.fromDB(&p.CIPDClient)
 	b.CIPDInput.Packages = make([]botCIPDPackage, len(p.CIPDPackages))
@@ -365,7 +521,7 @@ func (b *botPollManifest) fromRequest(t *model.TaskRequest, slice int) {
 	}
 	b.Command = p.Command
 	// TODO(maruel): b.Containment
-	b.Dimensions = messapi.ToStringPairs(p.Dimensions)
+	b.Dimensions = messapi.ToRepeatedStringPairs(p.Dimensions)
 	b.Env = messapi.ToStringPairs(p.Env)
 	b.EnvPrefixes = messapi.ToStringListPairs(p.EnvPrefixes)
 	b.GracePeriod = int64(p.GracePeriod / time.Second)
@@ -410,6 +566,12 @@ func (b *botCIPDPackage) fromDB(m *model.CIPDPackage) {
 	b.Path = m.Path
 }
 
+func (b *botCIPDPackage) toDB(m *model.CIPDPackage) {
+	m.PkgName = b.PkgName
+	m.Version = b.Version
+	m.Path = b.Path
+}
+
 type botPollCIPDInput struct {
 	ClientPackage botCIPDPackage   `json:"client_package"`
 	Packages      []botCIPDPackage `json:"packages"`
@@ -490,25 +652,171 @@ type botIDTokenResponse struct {
 }
 
 // botTaskUpdateRequest is arguments for /swarming/api/v1/bot/task_update.
+//
+// ExitCode is only set on the last update. The stats are only set once.
 type botTaskUpdateRequest struct {
 	botCommonRequest
-	BotOverheadSecs  float64      `json:"bot_overhead"`
-	CacheTrimStats   interface{}  `json:"cache_trim_stats"`
-	CASOutputRoot    interface{}  `json:"cas_output_root"`
-	CIPDPins         interface{}  `json:"cipd_pins"`
-	CIPDStats        interface{}  `json:"cipd_stats"`
-	CleanupStats     interface{}  `json:"cleanup_stats"`
-	CostUSD          float64      `json:"cost_usd"`
-	DurationSecs     float64      `json:"duration"`
-	ExitCode         int32        `json:"exit_code"`
-	HardTimeout      bool         `json:"hard_timeout"`
-	ID               string       `json:"id"`
-	IOTimeout        bool         `json:"io_timeout"`
-	IsolatedStats    interface{}  `json:"isolated_stats"`
-	NamedCachesStats interface{}  `json:"named_caches_stats"`
-	Output           []byte       `json:"output"`
-	OutputChunkStart int64        `json:"output_chunk_start"`
-	TaskID           model.TaskID `json:"task_id"`
+	BotOverheadSecs  float64              `json:"bot_overhead"`
+	CacheTrimStats   *botOperationStats   `json:"cache_trim_stats"`
+	Canceled         bool                 `json:"canceled"`
+	CASOutputRoot    *botCASReference     `json:"cas_output_root"`
+	CIPDPins         *botCIPDPins         `json:"cipd_pins"`
+	CIPDStats        *botCIPDStats        `json:"cipd_stats"`
+	CleanupStats     *botOperationStats   `json:"cleanup_stats"`
+	CostUSD          float64              `json:"cost_usd"`
+	DurationSecs     float64              `json:"duration"`
+	ExitCode         *int32               `json:"exit_code"`
+	HardTimeout      bool                 `json:"hard_timeout"`
+	ID               string               `json:"id"`
+	IOTimeout        bool                 `json:"io_timeout"`
+	IsolatedStats    *botIsolatedStats    `json:"isolated_stats"`
+	NamedCachesStats *botNamedCachesStats `json:"named_caches_stats"`
+	Output           []byte               `json:"output"`
+	OutputChunkStart int64                `json:"output_chunk_start"`
+	TaskID           model.TaskID         `json:"task_id"`
+}
+
+// toDB updates the task result with the output size, the cost, the CAS output,
+// the CIPD pins and the performance stats reported by the bot.
+func (b *botTaskUpdateRequest) toDB(m *model.TaskResult) error {
+	if end := b.OutputChunkStart + int64(len(b.Output)); end > m.TaskOutput.Size {
+		m.TaskOutput.Size = end
+	}
+	if b.CostUSD > m.Cost {
+		m.Cost = b.CostUSD
+	}
+	if b.CASOutputRoot != nil {
+		if err := b.CASOutputRoot.Digest.toDB(&m.Output); err != nil {
+			return err
+		}
+	}
+	if b.CIPDPins != nil {
+		b.CIPDPins.ClientPackage.toDB(&m.CIPDClientUsed)
+		m.CIPDPins = make([]model.CIPDPackage, len(b.CIPDPins.Packages))
+		for i := range b.CIPDPins.Packages {
+			b.CIPDPins.Packages[i].toDB(&m.CIPDPins[i])
+		}
+	}
+	if b.BotOverheadSecs != 0 {
+		m.Perf.BotOverhead = fromSecs(b.BotOverheadSecs)
+	}
+	if b.CacheTrimStats != nil {
+		m.Perf.CacheTrim = fromSecs(b.CacheTrimStats.DurationSecs)
+	}
+	if b.CIPDStats != nil {
+		m.Perf.PkgInstallation = fromSecs(b.CIPDStats.DurationSecs)
+	}
+	if b.CleanupStats != nil {
+		m.Perf.Cleanup = fromSecs(b.CleanupStats.DurationSecs)
+	}
+	if b.IsolatedStats != nil {
+		if d := b.IsolatedStats.Download; d != nil {
+			d.toDB(&m.Perf.CASDownload)
+		}
+		if u := b.IsolatedStats.Upload; u != nil {
+			u.toDB(&m.Perf.CASUpload)
+		}
+	}
+	if b.NamedCachesStats != nil {
+		m.Perf.NamedCachesInstall = fromSecs(b.NamedCachesStats.Install.DurationSecs)
+		m.Perf.NamedCachesUninstall = fromSecs(b.NamedCachesStats.Uninstall.DurationSecs)
+	}
+	return nil
+}
+
+type botCASReference struct {
+	CASInstance string    `json:"cas_instance"`
+	Digest      botDigest `json:"digest"`
+}
+
+// botDigest is a RBE-CAS digest as sent by the bot. Unlike messapi.Digest, the
+// size is a number.
+type botDigest struct {
+	Hash      string `json:"hash"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+func (b *botDigest) toDB(m *model.Digest) error {
+	if hex.DecodedLen(len(b.Hash)) != len(m.Hash) {
+		return fmt.Errorf("invalid digest hash %q", b.Hash)
+	}
+	if _, err := hex.Decode(m.Hash[:], []byte(b.Hash)); err != nil {
+		return fmt.Errorf("invalid digest hash %q: %w", b.Hash, err)
+	}
+	m.Size = b.SizeBytes
+	return nil
+}
+
+type botCIPDPins struct {
+	ClientPackage botCIPDPackage   `json:"client_package"`
+	Packages      []botCIPDPackage `json:"packages"`
+}
+
+type botOperationStats struct {
+	DurationSecs float64 `json:"duration"`
+}
+
+type botCIPDStats struct {
+	DurationSecs          float64 `json:"duration"`
+	GetClientDurationSecs float64 `json:"get_client_duration"`
+}
+
+type botIsolatedStats struct {
+	Download *botCASOperationStats `json:"download"`
+	Upload   *botCASOperationStats `json:"upload"`
+}
+
+type botCASOperationStats struct {
+	DurationSecs    float64 `json:"duration"`
+	InitialNumItems int64   `json:"initial_number_items"`
+	InitialSize     int64   `json:"initial_size"`
+	ItemsCold       []byte  `json:"items_cold"`
+	ItemsHot        []byte  `json:"items_hot"`
+}
+
+func (b *botCASOperationStats) toDB(m *model.CASOperationStats) {
+	m.Duration = fromSecs(b.DurationSecs)
+	m.InitialNumItems = b.InitialNumItems
+	m.InitialSize = b.InitialSize
+	m.ItemsCold = b.ItemsCold
+	m.ItemsHot = b.ItemsHot
+	m.NumItemsCold = countPacked(b.ItemsCold)
+	m.NumItemsHot = countPacked(b.ItemsHot)
+}
+
+type botNamedCachesStats struct {
+	Install   botOperationStats `json:"install"`
+	Uninstall botOperationStats `json:"uninstall"`
+}
+
+// countPacked returns the number of values in a zlib deflated list of varints
+// as packed by the bot. Returns 0 if it is invalid.
+func countPacked(b []byte) int64 {
+	if len(b) == 0 {
+		return 0
+	}
+	r, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return 0
+	}
+	n := int64(0)
+	for _, c := range raw {
+		// The last byte of a varint doesn't have the continuation bit.
+		if c&0x80 == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// fromSecs converts seconds as sent by the bot to a duration.
+func fromSecs(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond)
 }
 
 // botTaskUpdateResponse is arguments for /swarming/api/v1/bot/task_update.
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maruel/mess/internal"
+	"github.com/maruel/mess/internal/model"
+)
+
+func TestCountPacked(t *testing.T) {
+	pack := func(values ...uint64) []byte {
+		var raw []byte
+		for _, v := range values {
+			raw = binary.AppendUvarint(raw, v)
+		}
+		b := bytes.Buffer{}
+		w := zlib.NewWriter(&b)
+		w.Write(raw)
+		w.Close()
+		return b.Bytes()
+	}
+	data := []struct {
+		b    []byte
+		want int64
+	}{
+		{nil, 0},
+		{pack(), 0},
+		{pack(1), 1},
+		{pack(1, 127, 128, 300, 1<<40), 5},
+		// Not zlib.
+		{[]byte{1, 2, 3}, 0},
+		// Truncated.
+		{pack(1, 2, 3)[:4], 0},
+	}
+	for i, l := range data {
+		if got := countPacked(l.b); got != l.want {
+			t.Errorf("#%d: want %d, got %d", i, l.want, got)
+		}
+	}
+}
+
+func TestTaskUpdateFinalState(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		kill     bool
+		canceled bool
+		timeout  bool
+		want     model.TaskState
+	}{
+		{false, false, false, model.Completed},
+		{false, false, true, model.Timedout},
+		{false, true, false, model.Canceled},
+		// A killed task ends as KILLED, whether the bot started it or not.
+		{true, false, false, model.Killed},
+		{true, true, false, model.Killed},
+		{true, false, true, model.Killed},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		res := startTestTask(t, s, bot, testRequest(100, linux))
+		if l.kill {
+			if ok, wasRunning := s.sched.cancel(res.Key, true, testNow); !ok || !wasRunning {
+				t.Fatalf("#%d: %t %t", i, ok, wasRunning)
+			}
+		}
+		// The bot is told to stop the killed task.
+		resp := botTaskUpdateResponse{}
+		if code := botRequest(s, "bot1", "/task_update", botTaskUpdateRequest{TaskID: model.ToRunID(res.Key, 1)}, &resp); code != 200 || !resp.Ok || resp.MustStop != l.kill {
+			t.Fatalf("#%d: %d %+v", i, code, resp)
+		}
+		exitCode := int32(0)
+		req := botTaskUpdateRequest{TaskID: model.ToRunID(res.Key, 1), ExitCode: &exitCode, Canceled: l.canceled, HardTimeout: l.timeout}
+		if code := botRequest(s, "bot1", "/task_update", req, &resp); code != 200 || !resp.Ok {
+			t.Fatalf("#%d: %d %+v", i, code, resp)
+		}
+		if got := getResult(s, res.Key); got.State != l.want {
+			t.Errorf("#%d: want %d, got %d", i, l.want, got.State)
+		}
+	}
+}
+
+func TestTaskError(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	for i, idempotent := range []bool{false, true} {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		r := testRequest(100, linux)
+		// The bot API uses the wall clock to decide if the task can be retried.
+		r.Created = time.Now().UTC()
+		r.TaskSlices[0].Properties.Idempotent = idempotent
+		res := startTestTask(t, s, bot, r)
+		req := botTaskErrorRequest{TaskID: string(model.ToRunID(res.Key, 1)), Message: "failed to run"}
+		if code := botRequest(s, "bot1", "/task_error", req, nil); code != 200 {
+			t.Fatalf("#%d: %d", i, code)
+		}
+		got := getResult(s, res.Key)
+		if idempotent {
+			if got.State != model.Pending || len(got.PreviousRuns) != 1 || got.PreviousRuns[0].State != model.BotDied || got.PreviousRuns[0].InternalFailure != "failed to run" {
+				t.Errorf("#%d: %+v", i, got)
+			}
+		} else if got.State != model.BotDied || got.InternalFailure != "failed to run" {
+			t.Errorf("#%d: %+v", i, got)
+		}
+		if s.tables.BotGet("bot1", bot); bot.TaskID != 0 {
+			t.Errorf("#%d: %d", i, bot.TaskID)
+		}
+		// The task can't be updated anymore.
+		if code := botRequest(s, "bot1", "/task_update", botTaskUpdateRequest{TaskID: model.ToRunID(res.Key, 1)}, nil); code != 400 {
+			t.Errorf("#%d: %d", i, code)
+		}
+	}
+}
+
+func TestBotTaskBinding(t *testing.T) {
+	s := newTestServer(t)
+	linux := map[string][]string{"os": {"Linux"}}
+	bot1 := newTestBot(s, "bot1", linux)
+	newTestBot(s, "bot2", linux)
+	res := startTestTask(t, s, bot1, testRequest(100, linux))
+	exitCode := int32(0)
+	data := []struct {
+		bot  string
+		path string
+		in   interface{}
+		key  int64
+		err  string
+	}{
+		{"bot2", "/task_update", botTaskUpdateRequest{TaskID: model.ToRunID(res.Key, 1), ExitCode: &exitCode}, res.Key, "task %s is not assigned to this bot"},
+		{"bot2", "/task_error", botTaskErrorRequest{TaskID: string(model.ToRunID(res.Key, 1))}, res.Key, "task %s is not assigned to this bot"},
+		{"bot1", "/task_update", botTaskUpdateRequest{TaskID: model.ToRunID(42, 1)}, 42, "unknown task %s"},
+	}
+	for i, l := range data {
+		if code := botRequest(s, l.bot, l.path, l.in, nil); code != 400 {
+			t.Errorf("#%d: %d", i, code)
+		}
+		// The violation is logged.
+		events, _ := s.tables.BotEventGetSlice(l.bot, model.Filter{Limit: 10})
+		last := model.BotEvent{}
+		for _, e := range events {
+			if e.Key > last.Key {
+				last = e
+			}
+		}
+		if last.Event != "bot_error" || last.Message != fmt.Sprintf(l.err, model.ToTaskID(l.key)) {
+			t.Errorf("#%d: %+v", i, last)
+		}
+	}
+	// The task is untouched.
+	if got := getResult(s, res.Key); got.State != model.Running || got.BotID != "bot1" {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestHandshakeBotConfig(t *testing.T) {
+	s := newTestServer(t)
+	p := filepath.Join(t.TempDir(), "hooks.py")
+	script := "def get_dimensions(bot): pass\n"
+	if err := os.WriteFile(p, []byte(script), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	groups := []botGroup{{BotIDs: []string{"bot1"}, Pool: "p", BotConfig: p}, {BotIDs: []string{"bot2"}, Pool: "p"}}
+	var err error
+	if s.groups, err = newBotGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	rev := s.groups.rev
+	h := sha256.Sum256([]byte(script))
+	data := []struct {
+		bot    string
+		config string
+		rev    string
+		name   string
+	}{
+		{"bot1", script, hex.EncodeToString(h[:]), "hooks.py"},
+		{"bot2", "", internal.GetBotConfigRev(), "bot_config.py"},
+	}
+	for i, l := range data {
+		resp := botHandshakeResponse{}
+		if code := botRequest(s, l.bot, "/handshake", botHandshakeRequest{}, &resp); code != 200 {
+			t.Fatalf("#%d: %d", i, code)
+		}
+		if resp.BotConfig != l.config || resp.BotConfigRev != l.rev || resp.BotConfigName != l.name || resp.BotGroupCfgVersion != rev {
+			t.Errorf("#%d: %+v", i, resp)
+		}
+	}
+	// The group config version changes with the script.
+	if err = os.WriteFile(p, []byte("pass\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := newBotGroups(groups); err != nil || g.rev == rev {
+		t.Fatal(err, g.rev)
+	}
+}
+
+// startTestTask creates a task and starts it on a bot, like a poll.
+func startTestTask(t *testing.T, s *server, bot *model.Bot, r *model.TaskRequest) *model.TaskResult {
+	if got, _ := s.sched.pollNow(bot, testNow); got != nil {
+		t.Fatalf("unexpected task %d", got.r.Key)
+	}
+	res := newTestTask(t, s, r)
+	if res.State != model.Running || res.BotID != bot.Key {
+		t.Fatalf("task %d is not running on %s", res.Key, bot.Key)
+	}
+	s.tables.BotGet(bot.Key, bot)
+	bot.TaskID = res.Key
+	s.tables.BotSet(bot)
+	return res
+}
+
+// botRequest sends a bot API request from localhost and decodes the response.
+// Returns the HTTP status.
+func botRequest(s *server, botID, path string, in, out interface{}) int {
+	b, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest("POST", path, bytes.NewReader(b))
+	r.RemoteAddr = "127.0.0.1:1"
+	r.Header.Set("X-Luci-Swarming-Bot-ID", botID)
+	w := httptest.NewRecorder()
+	s.apiBot(w, r)
+	if out != nil {
+		_ = json.Unmarshal(w.Body.Bytes(), out)
+	}
+	return w.Code
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
 	"net/url"
 	"sort"
@@ -70,8 +72,8 @@ func fetchUserInfo(bearer string, res *userInfo) error {
 // If returns false, already sent 403.
 func (s *server) apiACL(w http.ResponseWriter, r *http.Request, acl aclType) bool {
 	local := isLocal(r)
-	if local && acl == canAccess {
-		// Fast allow.
+	if local && (acl == canAccess || s.local) {
+		// Fast allow. With -local, everyone on localhost is an admin.
 		return true
 	}
 	// Even if bound to localhost, check for transparent HTTP proxy header.
@@ -117,6 +119,12 @@ func (s *server) apiACL(w http.ResponseWriter, r *http.Request, acl aclType) boo
 		sendJSONResponse(w, errorStatus{status: 403})
 		return false
 	}
+	if acl == canBootstrap {
+		if _, ok := s.bootstrappers[user.Email]; !ok {
+			sendJSONResponse(w, errorStatus{status: 403})
+			return false
+		}
+	}
 	return true
 }
 
@@ -159,6 +167,10 @@ func (s *server) apiEndpoint(w http.ResponseWriter, r *http.Request) {
 		s.apiEndpointQueues(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/schedules/") {
+		s.apiEndpointSchedules(w, r)
+		return
+	}
 	ctx := r.Context()
 	if strings.HasPrefix(r.URL.Path, "/config/") {
 		log.Ctx(ctx).Error().Msg("TODO: implement luci config")
@@ -168,11 +180,21 @@ func (s *server) apiEndpoint(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) apiEndpointServer(w http.ResponseWriter, r *http.Request) {
-	// All server APIs are GET.
+	ctx := r.Context()
+	if r.URL.Path == "/server/token" {
+		// A token lets anyone download the bot code, so it requires more than
+		// canAccess.
+		if !s.apiACL(w, r, canBootstrap) || !isMethodJSON(w, r, "POST") {
+			return
+		}
+		log.Ctx(ctx).Info().Msg("issued bootstrap token")
+		sendJSONResponse(w, messapi.ServerTokenResponse{BootstrapToken: s.botAuth.newToken(time.Now())})
+		return
+	}
+	// All other server APIs are GET.
 	if !isMethodJSON(w, r, "GET") {
 		return
 	}
-	ctx := r.Context()
 	if r.URL.Path == "/server/details" {
 		sendJSONResponse(w, messapi.ServerDetailsResponse{
 			ServerVersion: s.version,
@@ -199,10 +221,14 @@ func (s *server) apiEndpointServer(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	if r.URL.Path == "/server/token" {
-		log.Ctx(ctx).Error().Msg("TODO: implement server token")
+	if r.URL.Path == "/server/shares" {
+		sendJSONResponse(w, messapi.ServerSharesResponse{
+			FairShare: s.sched.fairShare,
+			Shares:    s.sched.shares(),
+			Now:       messapi.CloudTime(time.Now()),
+		})
+		return
 	}
-
 	// Intentionally not implementing get_bootstrap and get_bot_config.
 	log.Ctx(ctx).Warn().Msg("Unknown client request")
 	sendJSONResponse(w, errorStatus{status: 404, err: errUnknownAPI})
@@ -220,32 +246,6 @@ func listToMap(l []string) map[string]string {
 	return out
 }
 
-func (s *server) getBotDimensions(pool string) map[string][]string {
-	// TODO(maruel): It has to be made more performant; O(n^3).
-	objs, _ := s.tables.BotGetSlice("", 1000)
-	dims := map[string][]string{}
-	for i := range objs {
-		for k, botvals := range objs[i].Dimensions {
-			for _, botval := range botvals {
-				found := false
-				for _, v := range dims[k] {
-					if botval == v {
-						found = true
-						break
-					}
-				}
-				if !found {
-					dims[k] = append(dims[k], botval)
-				}
-			}
-		}
-	}
-	for k := range dims {
-		sort.Strings(dims[k])
-	}
-	return dims
-}
-
 func (s *server) apiEndpointBots(w http.ResponseWriter, r *http.Request) {
 	// All bots APIs are GET.
 	if !isMethodJSON(w, r, "GET") {
@@ -283,7 +283,7 @@ func (s *server) apiEndpointBots(w http.ResponseWriter, r *http.Request) {
 			log.Ctx(ctx).Error().Interface("pool", req.Pool).Msg("TODO: implement bot pool")
 		}
 		sendJSONResponse(w, messapi.BotsDimensionsResponse{
-			BotsDimensions: messapi.ToStringListPairs(s.getBotDimensions("")),
+			BotsDimensions: messapi.ToStringListPairs(s.sched.botDimensions()),
 			Now:            cloudNow,
 		})
 		return
@@ -329,12 +329,24 @@ func (s *server) apiEndpointTasks(w http.ResponseWriter, r *http.Request) {
 		if t.Limit.Int64() == 0 {
 			t.Limit.Set64(100)
 		}
-		log.Ctx(ctx).Error().Msg("TODO: implement mass cancel")
-		sendJSONResponse(w, messapi.TasksCancelResponse{
-			Cursor:  "",
-			Now:     cloudNow,
-			Matched: "0",
-		})
+		if len(t.Tags) == 0 {
+			sendJSONResponse(w, errorStatus{status: 400, err: errors.New("tags are required")})
+			return
+		}
+		end := time.Time{}
+		if t.End != 0 {
+			sec, frac := math.Modf(t.End)
+			end = time.Unix(int64(sec), int64(frac*1e9))
+		}
+		n, cursor, err := s.sched.cancelTasks(t.Tags, end, t.KillRunning, t.Cursor, int(t.Limit.Int64()), now)
+		if err != nil {
+			sendJSONResponse(w, errorStatus{status: 400, err: err})
+			return
+		}
+		log.Ctx(ctx).Info().Strs("tags", t.Tags).Int("matched", n).Msg("mass cancel")
+		resp := messapi.TasksCancelResponse{Cursor: cursor, Now: cloudNow}
+		resp.Matched.Set64(int64(n))
+		sendJSONResponse(w, resp)
 		return
 	}
 	if r.URL.Path == "/tasks/count" {
@@ -393,14 +405,19 @@ func (s *server) apiEndpointTasks(w http.ResponseWriter, r *http.Request) {
 			Sort:                    r.FormValue("sort"),
 			IncludePerformanceStats: messapi.ToBool(r.FormValue("include_performance_stats")),
 		}
-		log.Ctx(ctx).Error().Msg("TODO: implement State, Tags, Sort, Perf")
+		log.Ctx(ctx).Error().Msg("TODO: implement Tags, Sort")
+		state, err := messapi.ToTaskStateQuery(req.State)
+		if err != nil {
+			sendJSONResponse(w, errorStatus{status: 400, err: err})
+			return
+		}
 		f := model.Filter{
 			Cursor:   req.Cursor,
 			Limit:    int(req.Limit),
 			Earliest: req.Start,
 			Latest:   req.End,
 		}
-		objs, cursor := s.tables.TaskResultSlice("", f, model.TaskStateQueryAll, model.TaskSortCreated)
+		objs, cursor := s.tables.TaskResultSlice("", f, state, model.TaskSortCreated)
 		items := make([]messapi.TaskResult, len(objs))
 		robj := model.TaskRequest{}
 		for i := range objs {
@@ -422,27 +439,18 @@ func (s *server) apiEndpointTasks(w http.ResponseWriter, r *http.Request) {
 		}
 		m := model.TaskRequest{SchemaVersion: 1}
 		t.ToDB(now, &m)
-		if err := m.ValidateAndSetDefaults(); err != nil {
-			sendJSONResponse(w, errorStatus{status: 400, err: err})
+		n, err := s.newTask(ctx, &m, now)
+		if err != nil {
+			status := 400
+			if errors.Is(err, errQuota) {
+				status = 429
+			}
+			sendJSONResponse(w, errorStatus{status: status, err: err})
 			return
 		}
-
-		// First, save to DB.
-		s.tables.TaskRequestAdd(&m)
-		n := model.TaskResult{
-			Key:            m.Key,
-			SchemaVersion:  1,
-			Modified:       now,
-			State:          model.Pending,
-			ServerVersions: []string{s.version},
-		}
-		s.tables.TaskResultSet(&n)
-		if s.sched.enqueue(ctx, &m, &n) {
-			s.tables.TaskResultSet(&n)
-		}
 		resp := messapi.TasksNewResponse{TaskID: model.ToTaskID(m.Key)}
 		resp.Request.FromDB(&m)
-		resp.Result.FromDB(&m, &n, false)
+		resp.Result.FromDB(&m, n, false)
 		sendJSONResponse(w, resp)
 		return
 	}
@@ -557,14 +565,19 @@ func (s *server) apiEndpointBot(w http.ResponseWriter, r *http.Request) {
 				Sort:                    r.FormValue("sort"),
 				IncludePerformanceStats: messapi.ToBool(r.FormValue("include_performance_stats")),
 			}
-			log.Ctx(ctx).Error().Msg("TODO: State and Sort")
+			log.Ctx(ctx).Error().Msg("TODO: Sort")
+			state, err := messapi.ToTaskStateQuery(req.State)
+			if err != nil {
+				sendJSONResponse(w, errorStatus{status: 400, err: err})
+				return
+			}
 			f := model.Filter{
 				Cursor:   req.Cursor,
 				Limit:    int(req.Limit),
 				Earliest: req.Start,
 				Latest:   req.End,
 			}
-			objs, cursor := s.tables.TaskResultSlice(id, f, model.TaskStateQueryAll, model.TaskSortCreated)
+			objs, cursor := s.tables.TaskResultSlice(id, f, state, model.TaskSortCreated)
 			items := make([]messapi.TaskResult, len(objs))
 			robj := model.TaskRequest{}
 			for i := range objs {
@@ -578,14 +591,45 @@ func (s *server) apiEndpointBot(w http.ResponseWriter, r *http.Request) {
 				Now:    cloudNow,
 			})
 			return
+		case "restart":
+			req := messapi.BotRestartRequest{}
+			if !readPOSTJSON(w, r, &req) {
+				return
+			}
+			bot := model.Bot{}
+			if s.tables.BotGet(id, &bot); bot.Key == "" || bot.Deleted {
+				sendJSONResponse(w, errorStatus{status: 404, err: errors.New("unknown bot")})
+				return
+			}
+			if req.Message == "" {
+				req.Message = "Restart requested by an admin"
+			}
+			bot.RestartMsg = req.Message
+			s.tables.BotSet(&bot)
+			sendJSONResponse(w, messapi.BotRestartResponse{Ok: true})
+			return
 		case "terminate":
 			// It's a POST but with nothing in it.
 			if !readPOSTJSON(w, r, &struct{}{}) {
 				return
 			}
-			log.Ctx(ctx).Error().Msg("TODO: implement terminate bot")
+			bot := model.Bot{}
+			if s.tables.BotGet(id, &bot); bot.Key == "" || bot.Deleted {
+				sendJSONResponse(w, errorStatus{status: 404, err: errors.New("unknown bot")})
+				return
+			}
+			now := time.Now()
+			m := newTerminateTask(id, now)
+			if _, err := s.newTask(ctx, m, now); err != nil {
+				status := 400
+				if errors.Is(err, errQuota) {
+					status = 429
+				}
+				sendJSONResponse(w, errorStatus{status: status, err: err})
+				return
+			}
 			sendJSONResponse(w, messapi.BotTerminateResponse{
-				TaskID: "",
+				TaskID: model.ToTaskID(m.Key),
 			})
 			return
 		}
@@ -605,16 +649,14 @@ func (s *server) apiEndpointTask(w http.ResponseWriter, r *http.Request) {
 		}
 		switch n[1] {
 		case "cancel":
-			// It's a POST but with nothing in it.
-			if !readPOSTJSON(w, r, &struct{}{}) {
+			req := messapi.TaskCancelRequest{}
+			if !readPOSTJSON(w, r, &req) {
 				return
 			}
-			t := model.TaskResult{}
-			s.tables.TaskResultGet(id, &t)
-			log.Ctx(ctx).Error().Msg("TODO: implement cancel")
+			ok, wasRunning := s.sched.cancel(id, req.KillRunning, time.Now())
 			sendJSONResponse(w, messapi.TaskCancelResponse{
-				Ok:         false,
-				WasRunning: t.State == model.Running,
+				Ok:         ok,
+				WasRunning: wasRunning,
 			})
 			return
 		case "request":
@@ -638,8 +680,20 @@ func (s *server) apiEndpointTask(w http.ResponseWriter, r *http.Request) {
 			s.tables.TaskRequestGet(id, &robj)
 			t := model.TaskResult{}
 			s.tables.TaskResultGet(id, &t)
+			if try := model.TryNumber(model.TaskID(n[0])); try != 0 && try != t.TryNumber {
+				// It's the run ID of a previous attempt.
+				if !previousRun(&t, try) {
+					sendJSONResponse(w, errorStatus{status: 404, err: errors.New("unknown run id")})
+					return
+				}
+			}
 			resp := messapi.TaskResultResponse{}
 			resp.FromDB(&robj, &t, req.IncludePerformanceStats)
+			if t.State == model.Pending {
+				if eta, ok := s.sched.eta(id, time.Now()); ok {
+					resp.EstimatedStart = messapi.CloudTime(eta)
+				}
+			}
 			sendJSONResponse(w, resp)
 			return
 		case "stdout":
@@ -650,11 +704,15 @@ func (s *server) apiEndpointTask(w http.ResponseWriter, r *http.Request) {
 				Offset: messapi.ToInt64(r.FormValue("offset"), 0),
 				Length: messapi.ToInt64(r.FormValue("length"), 16*1000*1024),
 			}
+			t := model.TaskResult{}
+			s.tables.TaskResultGet(id, &t)
+			if t.DedupedFrom != 0 {
+				// The output is the one of the original task.
+				id = t.DedupedFrom
+			}
 			// TODO(maruel): This is unsafe, if there are two simultaneous requests,
 			// they will corrupt the buffer.
 			out, _ := s.outputs.ReadOutput(id, req.Offset, int(req.Length))
-			t := model.TaskResult{}
-			s.tables.TaskResultGet(id, &t)
 			// Encode? I forget.
 			resp := messapi.TaskStdoutResponse{Output: string(out)}
 			resp.State.FromDB(t.State)
@@ -667,6 +725,95 @@ func (s *server) apiEndpointTask(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, errorStatus{status: 404, err: errUnknownAPI})
 }
 
+// dedupeMaxAge is how old a successful task can be to be reused by an
+// idempotent task, like Swarming.
+const dedupeMaxAge = 7 * 24 * time.Hour
+
+// newTask validates, saves and enqueues a new task.
+//
+// Returns an error wrapping errQuota if the task is rejected by a quota.
+func (s *server) newTask(ctx context.Context, m *model.TaskRequest, now time.Time) (*model.TaskResult, error) {
+	if err := m.ValidateAndSetDefaults(); err != nil {
+		return nil, err
+	}
+	if err := s.sched.admit(m); err != nil {
+		return nil, err
+	}
+
+	// First, save to DB.
+	s.tables.TaskRequestAdd(m)
+	n := &model.TaskResult{
+		Key:            m.Key,
+		SchemaVersion:  1,
+		Modified:       now,
+		State:          model.Pending,
+		ServerVersions: []string{s.version},
+	}
+	s.tables.TaskResultSet(n)
+	if s.dedupe(m, n, now) {
+		s.sched.release(m)
+		s.tables.TaskResultSet(n)
+	} else {
+		s.sched.enqueue(ctx, m, n)
+	}
+	return n, nil
+}
+
+// dedupe looks for a recent successful task with the same properties as one of
+// the task slices if it is idempotent, and reuses its result.
+//
+// Returns true if res was deduped.
+func (s *server) dedupe(r *model.TaskRequest, res *model.TaskResult, now time.Time) bool {
+	since := now.Add(-dedupeMaxAge)
+	d := model.TaskResult{}
+	for i := range r.TaskSlices {
+		p := &r.TaskSlices[i].Properties
+		if !p.Idempotent || !s.tables.TaskResultDupe(p.Hash(), since, &d) {
+			continue
+		}
+		res.BotID = d.BotID
+		res.BotVersion = d.BotVersion
+		res.BotDimensions = d.BotDimensions
+		res.BotIdleSince = d.BotIdleSince
+		res.CurrentTaskSlice = int32(i)
+		res.DedupedFrom = d.Key
+		res.TaskOutput = d.TaskOutput
+		res.ExitCode = d.ExitCode
+		res.State = model.Completed
+		res.Output = d.Output
+		res.CIPDClientUsed = d.CIPDClientUsed
+		res.CIPDPins = d.CIPDPins
+		res.Duration = d.Duration
+		res.Started = d.Started
+		res.Completed = d.Completed
+		res.Modified = now
+		return true
+	}
+	return false
+}
+
+// previousRun overwrites the current run information with the one of a
+// previous try of the task.
+func previousRun(t *model.TaskResult, try int32) bool {
+	for i := range t.PreviousRuns {
+		if p := &t.PreviousRuns[i]; p.TryNumber == try {
+			t.TryNumber = p.TryNumber
+			t.BotID = p.BotID
+			t.BotVersion = p.BotVersion
+			t.BotDimensions = p.BotDimensions
+			t.State = p.State
+			t.InternalFailure = p.InternalFailure
+			t.Started = p.Started
+			t.Abandoned = p.Abandoned
+			t.Completed = time.Time{}
+			t.Duration = 0
+			t.ExitCode = 0
+			return true
+		}
+	}
+	return false
+}
+
 func (s *server) apiEndpointQueues(w http.ResponseWriter, r *http.Request) {
 	// All queues APIs are GET.
 	if !isMethodJSON(w, r, "GET") {
@@ -674,12 +821,113 @@ func (s *server) apiEndpointQueues(w http.ResponseWriter, r *http.Request) {
 	}
 	ctx := r.Context()
 	if r.URL.Path == "/queues/list" {
-		_ = messapi.TaskQueuesListRequest{
+		req := messapi.TaskQueuesListRequest{
+			Limit:  messapi.ToInt64(r.FormValue("limit"), 200),
+			Cursor: r.FormValue("cursor"),
+		}
+		if req.Limit <= 0 {
+			sendJSONResponse(w, errorStatus{status: 400, err: errors.New("invalid limit")})
+			return
+		}
+		now := time.Now()
+		items, cursor, err := s.sched.taskQueues(req.Cursor, int(req.Limit), now)
+		if err != nil {
+			sendJSONResponse(w, errorStatus{status: 400, err: err})
+			return
+		}
+		sendJSONResponse(w, messapi.TaskQueuesListResponse{
+			Cursor: cursor,
+			Items:  items,
+			Now:    messapi.CloudTime(now),
+		})
+		return
+	}
+	if r.URL.Path == "/queues/stats" {
+		req := messapi.TaskQueueStatsRequest{
+			Dimensions: r.Form["dimensions"],
+			Priority:   messapi.ToInt64(r.FormValue("priority"), 200),
+		}
+		dims := map[string][]string{}
+		for _, d := range req.Dimensions {
+			k, v, ok := strings.Cut(d, ":")
+			if !ok {
+				sendJSONResponse(w, errorStatus{status: 400, err: errors.New("bad dimensions format")})
+				return
+			}
+			dims[k] = append(dims[k], v)
+		}
+		// Normalize like model.TaskProperties.ValidateAndSetDefaults() so the order
+		// in the query string doesn't matter.
+		for _, v := range dims {
+			sort.Strings(v)
+		}
+		resp, ok := s.sched.queueStats(dims, int32(req.Priority), time.Now())
+		if !ok {
+			sendJSONResponse(w, errorStatus{status: 404, err: errors.New("unknown queue")})
+			return
+		}
+		sendJSONResponse(w, resp)
+		return
+	}
+
+	log.Ctx(ctx).Warn().Msg("Unknown client request")
+	sendJSONResponse(w, errorStatus{status: 404, err: errUnknownAPI})
+}
+
+// apiEndpointSchedules handles the schedules, which are specific to mess.
+func (s *server) apiEndpointSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now().UTC()
+	cloudNow := messapi.CloudTime(now)
+	if r.URL.Path == "/schedules/list" {
+		if !isMethodJSON(w, r, "GET") {
+			return
+		}
+		req := messapi.SchedulesListRequest{
 			Limit:  messapi.ToInt64(r.FormValue("limit"), 200),
 			Cursor: r.FormValue("cursor"),
 		}
-		log.Ctx(ctx).Error().Msg("TODO: implement query task queues")
-		sendJSONResponse(w, messapi.TaskQueuesListResponse{})
+		if req.Limit <= 0 {
+			sendJSONResponse(w, errorStatus{status: 400, err: errors.New("invalid limit")})
+			return
+		}
+		objs, cursor := s.tables.ScheduleGetSlice(req.Cursor, int(req.Limit))
+		items := make([]messapi.Schedule, len(objs))
+		for i := range objs {
+			items[i].FromDB(&objs[i])
+		}
+		sendJSONResponse(w, messapi.SchedulesListResponse{
+			Cursor: cursor,
+			Items:  items,
+			Now:    cloudNow,
+		})
+		return
+	}
+	if r.URL.Path == "/schedules/new" {
+		req := messapi.SchedulesNewRequest{}
+		if !readPOSTJSON(w, r, &req) {
+			return
+		}
+		sch, err := s.sched.newSchedule(&req, now)
+		if err != nil {
+			status := 400
+			if errors.Is(err, errScheduleExists) {
+				status = 409
+			}
+			sendJSONResponse(w, errorStatus{status: status, err: err})
+			return
+		}
+		resp := messapi.SchedulesNewResponse{Now: cloudNow}
+		resp.Schedule.FromDB(sch)
+		sendJSONResponse(w, resp)
+		return
+	}
+	if r.URL.Path == "/schedules/delete" {
+		req := messapi.SchedulesDeleteRequest{}
+		if !readPOSTJSON(w, r, &req) {
+			return
+		}
+		sendJSONResponse(w, messapi.SchedulesDeleteResponse{Deleted: s.sched.deleteSchedule(req.Name)})
 		return
 	}
 
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maruel/mess/internal"
+	"github.com/maruel/mess/internal/model"
+	"github.com/maruel/mess/messapi"
+)
+
+func TestServerTokenACL(t *testing.T) {
+	data := []struct {
+		local  bool
+		remote string
+		bearer string
+		want   int
+	}{
+		// Anyone on localhost can access the server but only -local lets them get
+		// a token without authenticating.
+		{false, "127.0.0.1:1", "", 403},
+		{true, "127.0.0.1:1", "", 200},
+		{false, "10.0.0.1:1", "Bearer user", 403},
+		{false, "10.0.0.1:1", "Bearer bootstrapper", 200},
+		{false, "127.0.0.1:1", "Bearer bootstrapper", 200},
+		{false, "10.0.0.1:1", "Bearer unverified", 403},
+		{false, "10.0.0.1:1", "Bearer stranger", 403},
+		// -local refuses remote requests.
+		{true, "10.0.0.1:1", "Bearer bootstrapper", 403},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		s.local = l.local
+		s.allowed = map[string]struct{}{"user@example.com": {}, "bootstrapper@example.com": {}, "unverified@example.com": {}}
+		s.bootstrappers = map[string]struct{}{"bootstrapper@example.com": {}, "unverified@example.com": {}}
+		s.authCache["Bearer user"] = &userInfo{Email: "user@example.com", EmailVerified: true}
+		s.authCache["Bearer bootstrapper"] = &userInfo{Email: "bootstrapper@example.com", EmailVerified: true}
+		s.authCache["Bearer unverified"] = &userInfo{Email: "unverified@example.com"}
+		s.authCache["Bearer stranger"] = &userInfo{Email: "stranger@example.com", EmailVerified: true}
+		r := httptest.NewRequest("POST", "/server/token", nil)
+		r.RemoteAddr = l.remote
+		if l.bearer != "" {
+			r.Header.Set("Authorization", l.bearer)
+		}
+		w := httptest.NewRecorder()
+		s.apiEndpoint(w, r)
+		if w.Code != l.want {
+			t.Errorf("#%d: want %d, got %d", i, l.want, w.Code)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	linux := map[string][]string{"os": {"Linux"}}
+	data := []struct {
+		exitCode   int32
+		completed  time.Duration
+		idempotent bool
+		want       bool
+	}{
+		{0, 0, true, true},
+		{1, 0, true, false},
+		{0, 0, false, false},
+		{0, -dedupeMaxAge, true, false},
+	}
+	for i, l := range data {
+		s := newTestServer(t)
+		bot := newTestBot(s, "bot1", linux)
+		r := testRequest(100, linux)
+		r.TaskSlices[0].Properties.Idempotent = true
+		first := startTestTask(t, s, bot, r)
+		s.sched.updateResult(first.Key, func(res *model.TaskResult) bool {
+			res.State = model.Completed
+			res.ExitCode = l.exitCode
+			res.Completed = testNow.Add(l.completed)
+			res.Duration = time.Second
+			return true
+		})
+		// The second task has the same properties.
+		r = testRequest(100, linux)
+		r.TaskSlices[0].Properties.Idempotent = l.idempotent
+		res := newTestTask(t, s, r)
+		if !l.want {
+			if res.State != model.Pending || res.DedupedFrom != 0 {
+				t.Errorf("#%d: %+v", i, res)
+			}
+			continue
+		}
+		if res.State != model.Completed || res.DedupedFrom != first.Key || res.BotID != "bot1" || res.Duration != time.Second {
+			t.Errorf("#%d: %+v", i, res)
+		}
+		// A deduped result is not reused itself.
+		s.tables.TaskResultSet(&model.TaskResult{Key: first.Key, SchemaVersion: 1, State: model.Canceled})
+		r = testRequest(100, linux)
+		r.TaskSlices[0].Properties.Idempotent = true
+		if res = newTestTask(t, s, r); res.State != model.Pending {
+			t.Errorf("#%d: %+v", i, res)
+		}
+	}
+}
+
+func TestBotRestartTerminate(t *testing.T) {
+	s := newTestServer(t)
+	s.local = true
+	newTestBot(s, "bot1", map[string][]string{"os": {"Linux"}})
+	// The bot is up to date so it is not told to update itself.
+	version := internal.GetBotVersion(context.Background(), getURL(httptest.NewRequest("POST", "/poll", nil)))
+	poll := func() botPollResponse {
+		resp := botPollResponse{}
+		req := botPollRequest{botCommonRequest: botCommonRequest{Version: version}}
+		if code := botRequest(s, "bot1", "/poll", req, &resp); code != 200 {
+			t.Fatal(code)
+		}
+		return resp
+	}
+
+	if code := clientRequest(s, "/bot/bot1/restart", messapi.BotRestartRequest{Message: "upgrade"}, nil); code != 200 {
+		t.Fatal(code)
+	}
+	if resp := poll(); resp.Cmd != "bot_restart" || resp.Message != "upgrade" {
+		t.Fatalf("%+v", resp)
+	}
+	bot := model.Bot{}
+	if s.tables.BotGet("bot1", &bot); bot.RestartMsg != "" {
+		t.Fatal(bot.RestartMsg)
+	}
+
+	term := messapi.BotTerminateResponse{}
+	if code := clientRequest(s, "/bot/bot1/terminate", struct{}{}, &term); code != 200 || term.TaskID == "" {
+		t.Fatal(code, term)
+	}
+	if resp := poll(); resp.Cmd != "terminate" || resp.TaskID != string(term.TaskID) {
+		t.Fatalf("%+v", resp)
+	}
+	if s.tables.BotGet("bot1", &bot); bot.TaskID != model.FromTaskID(term.TaskID) {
+		t.Fatal(bot.TaskID)
+	}
+	events, _ := s.tables.BotEventGetSlice("bot1", model.Filter{Limit: 10})
+	found := map[string]string{}
+	for _, e := range events {
+		found[e.Event] = e.Message
+	}
+	if found["request_restart"] != "upgrade" || found["bot_terminate"] != string(term.TaskID) {
+		t.Fatal(found)
+	}
+
+	// Unknown bot.
+	if code := clientRequest(s, "/bot/bot2/restart", messapi.BotRestartRequest{}, nil); code != 404 {
+		t.Fatal(code)
+	}
+	if code := clientRequest(s, "/bot/bot2/terminate", struct{}{}, nil); code != 404 {
+		t.Fatal(code)
+	}
+}
+
+// clientRequest sends a client API POST request from localhost and decodes the
+// response. Returns the HTTP status.
+func clientRequest(s *server, path string, in, out interface{}) int {
+	b, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest("POST", path, bytes.NewReader(b))
+	r.RemoteAddr = "127.0.0.1:1"
+	w := httptest.NewRecorder()
+	s.apiEndpoint(w, r)
+	if out != nil {
+		_ = json.Unmarshal(w.Body.Bytes(), out)
+	}
+	return w.Code
+}
@@ -68,13 +68,28 @@ func GetBotZIP(ctx context.Context, url string) []byte {
 	if _, err = f.Write(cfg); err != nil {
 		panic(err)
 	}
+	mu.Lock()
+	botCfg := botConfig
+	mu.Unlock()
+	if botCfg != nil {
+		names = append(names, "config/bot_config.py")
+		f, err := w.Create("config/bot_config.py")
+		if err != nil {
+			panic(err)
+		}
+		if _, err = f.Write(botCfg); err != nil {
+			panic(err)
+		}
+	}
 	for _, f := range r.File {
+		if botCfg != nil && f.Name == "config/bot_config.py" {
+			continue
+		}
 		names = append(names, f.Name)
 		if err := w.Copy(f); err != nil {
 			panic(err)
 		}
 	}
-	// TODO(maruel): Inject config/bot_config.py.
 	if err := w.Close(); err != nil {
 		panic(err)
 	}
@@ -83,6 +98,8 @@ func GetBotZIP(ctx context.Context, url string) []byte {
 	for _, n := range names {
 		if n == "config/config.json" {
 			hashFile(h, "config/config.json", cfg)
+		} else if botCfg != nil && n == "config/bot_config.py" {
+			hashFile(h, "config/bot_config.py", botCfg)
 		} else {
 			c, err := r.Open(n)
 			if err != nil {
@@ -120,6 +137,49 @@ func GetBotZIP(ctx context.Context, url string) []byte {
 	return b
 }
 
+// SetBotConfig overrides config/bot_config.py in swarming_bot.zip.
+//
+// nil restores the default one. The bot version changes with the content so
+// the bots self-update. It is meant to be called on startup.
+func SetBotConfig(raw []byte) {
+	mu.Lock()
+	botConfig = raw
+	botConfigRev = ""
+	botCode = map[string][]byte{}
+	botVersion = map[string]string{}
+	mu.Unlock()
+}
+
+// GetBotConfigRev returns the hash of config/bot_config.py in swarming_bot.zip.
+func GetBotConfigRev() string {
+	mu.Lock()
+	v, raw := botConfigRev, botConfig
+	mu.Unlock()
+	if v != "" {
+		return v
+	}
+	if raw == nil {
+		r, err := zip.NewReader(bytes.NewReader(botZipRaw[:]), int64(len(botZipRaw)))
+		if err != nil {
+			panic(err)
+		}
+		c, err := r.Open("config/bot_config.py")
+		if err != nil {
+			panic(err)
+		}
+		if raw, err = ioutil.ReadAll(c); err != nil {
+			panic(err)
+		}
+		c.Close()
+	}
+	h := sha256.Sum256(raw)
+	v = hex.EncodeToString(h[:])
+	mu.Lock()
+	botConfigRev = v
+	mu.Unlock()
+	return v
+}
+
 func hashFile(h io.Writer, name string, raw []byte) {
 	_, _ = h.Write([]byte(strconv.Itoa(len(name))))
 	_, _ = h.Write([]byte(name))
@@ -134,7 +194,9 @@ type config struct {
 }
 
 var (
-	mu         sync.Mutex
-	botCode    = map[string][]byte{}
-	botVersion = map[string]string{}
+	mu           sync.Mutex
+	botCode      = map[string][]byte{}
+	botVersion   = map[string]string{}
+	botConfig    []byte
+	botConfigRev string
 )
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestSetBotConfig(t *testing.T) {
+	t.Cleanup(func() { SetBotConfig(nil) })
+	ctx := context.Background()
+	const url = "http://localhost:1"
+	defVersion := GetBotVersion(ctx, url)
+	defRev := GetBotConfigRev()
+
+	SetBotConfig([]byte("def get_dimensions(bot): pass\n"))
+	if v := GetBotVersion(ctx, url); v == defVersion {
+		t.Fatal("the version must change with the bot config")
+	}
+	h := sha256.Sum256([]byte("def get_dimensions(bot): pass\n"))
+	if rev := GetBotConfigRev(); rev != hex.EncodeToString(h[:]) {
+		t.Fatal(rev)
+	}
+	b := GetBotZIP(ctx, url)
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, f := range r.File {
+		if f.Name != "config/bot_config.py" {
+			continue
+		}
+		c, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, string(raw))
+	}
+	if len(found) != 1 || found[0] != "def get_dimensions(bot): pass\n" {
+		t.Fatal(found)
+	}
+
+	// Restore the default one.
+	SetBotConfig(nil)
+	if v := GetBotVersion(ctx, url); v != defVersion {
+		t.Fatal(v)
+	}
+	if rev := GetBotConfigRev(); rev != defRev {
+		t.Fatal(rev)
+	}
+}
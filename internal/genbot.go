@@ -56,7 +56,7 @@ var botFiles = []string{
 	"client/local_caching.py",
 	"client/run_isolated.py",
 	"config/__init__.py",
-	// TODO(maruel): Temporary:
+	// Default hooks, can be overridden with SetBotConfig().
 	"config/bot_config.py",
 	"libs/__init__.py",
 	"libs/luci_context/__init__.py",
@@ -24,6 +24,7 @@ type Bot struct {
 	Dimensions      map[string][]string `json:"l,omitempty"`
 	State           []byte              `json:"m,omitempty"`
 	ExternalIP      string              `json:"n,omitempty"`
+	RestartMsg      string              `json:"o,omitempty"`
 }
 
 type botSQL struct {
@@ -72,6 +73,7 @@ func (b *botSQL) from(d *Bot) {
 		Dimensions:      d.Dimensions,
 		State:           d.State,
 		ExternalIP:      d.ExternalIP,
+		RestartMsg:      d.RestartMsg,
 	}
 	var err error
 	b.blob, err = json.Marshal(&s)
@@ -99,6 +101,7 @@ func (b *botSQL) to(d *Bot) {
 	d.Dimensions = s.Dimensions
 	d.State = s.State
 	d.ExternalIP = s.ExternalIP
+	d.RestartMsg = s.RestartMsg
 }
 
 // See:
@@ -128,4 +131,5 @@ type botSQLBlob struct {
 	Dimensions      map[string][]string `json:"b,omitempty"`
 	State           []byte              `json:"c,omitempty"`
 	ExternalIP      string              `json:"d,omitempty"`
+	RestartMsg      string              `json:"e,omitempty"`
 }
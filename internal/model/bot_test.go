@@ -87,6 +87,44 @@ func TestBotSQL(t *testing.T) {
 	}
 }
 
+func TestBotGetSlice(t *testing.T) {
+	dbs := map[string]func(string) (DB, error){"json": NewDBJSON, "sqlite3": NewDBSqlite3}
+	for name, open := range dbs {
+		t.Run(name, func(t *testing.T) {
+			d, err := open(filepath.Join(t.TempDir(), "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			for _, k := range []string{"bot3", "bot1", "bot4", "bot2"} {
+				b := getBot()
+				b.Key = k
+				b.Deleted = k == "bot2"
+				d.BotSet(b)
+			}
+			data := []struct {
+				limit int
+				want  []string
+			}{
+				{10, []string{"bot1", "bot3", "bot4"}},
+				{3, []string{"bot1", "bot3", "bot4"}},
+				{2, []string{"bot1", "bot3"}},
+				{1, []string{"bot1"}},
+			}
+			for i, l := range data {
+				all, _ := d.BotGetSlice("", l.limit)
+				var got []string
+				for _, b := range all {
+					got = append(got, b.Key)
+				}
+				if !reflect.DeepEqual(l.want, got) {
+					t.Errorf("#%d: want %v, got %v", i, l.want, got)
+				}
+			}
+		})
+	}
+}
+
 func TestBotNonZero(t *testing.T) {
 	r := getBot()
 	if err := isNonZero("", reflect.ValueOf(r)); err != nil {
@@ -118,5 +156,6 @@ func getBot() *Bot {
 		Dimensions:      map[string][]string{"a": {"b", "c"}},
 		State:           []byte(`{"python": "2.7"}`),
 		ExternalIP:      "1.2.3.4",
+		RestartMsg:      "new config",
 	}
 }
@@ -44,6 +44,74 @@ const (
 	TaskStateQueryNoResource
 )
 
+// match returns true if the TaskResult is in the queried state.
+func (s TaskStateQuery) match(r *TaskResult) bool {
+	switch s {
+	case TaskStateQueryPending:
+		return r.State == Pending
+	case TaskStateQueryRunning:
+		return r.State == Running
+	case TaskStateQueryPendingRunning:
+		return r.State == Pending || r.State == Running
+	case TaskStateQueryCompleted:
+		return r.State == Completed
+	case TaskStateQueryCompletedSuccess:
+		return r.State == Completed && r.ExitCode == 0
+	case TaskStateQueryCompletedFailure:
+		return r.State == Completed && r.ExitCode != 0
+	case TaskStateQueryExpired:
+		return r.State == Expired
+	case TaskStateQueryTimedOut:
+		return r.State == Timedout
+	case TaskStateQueryBotDied:
+		return r.State == BotDied
+	case TaskStateQueryCanceled:
+		return r.State == Canceled
+	case TaskStateQueryDeduped:
+		return r.DedupedFrom != 0
+	case TaskStateQueryKilled:
+		return r.State == Killed
+	case TaskStateQueryNoResource:
+		return r.State == NoResource
+	default:
+		return true
+	}
+}
+
+// sqlWhere returns the SQL condition for the queried state, if any.
+func (s TaskStateQuery) sqlWhere() string {
+	switch s {
+	case TaskStateQueryPending:
+		return fmt.Sprintf("state = %d", Pending)
+	case TaskStateQueryRunning:
+		return fmt.Sprintf("state = %d", Running)
+	case TaskStateQueryPendingRunning:
+		return fmt.Sprintf("state IN (%d, %d)", Pending, Running)
+	case TaskStateQueryCompleted:
+		return fmt.Sprintf("state = %d", Completed)
+	case TaskStateQueryCompletedSuccess:
+		return fmt.Sprintf("state = %d AND exitCode = 0", Completed)
+	case TaskStateQueryCompletedFailure:
+		return fmt.Sprintf("state = %d AND exitCode != 0", Completed)
+	case TaskStateQueryExpired:
+		return fmt.Sprintf("state = %d", Expired)
+	case TaskStateQueryTimedOut:
+		return fmt.Sprintf("state = %d", Timedout)
+	case TaskStateQueryBotDied:
+		return fmt.Sprintf("state = %d", BotDied)
+	case TaskStateQueryCanceled:
+		return fmt.Sprintf("state = %d", Canceled)
+	case TaskStateQueryDeduped:
+		return "dedupedFrom != 0"
+	case TaskStateQueryKilled:
+		return fmt.Sprintf("state = %d", Killed)
+	case TaskStateQueryNoResource:
+		return fmt.Sprintf("state = %d", NoResource)
+	default:
+		return ""
+	}
+}
+
 // Filter is a set of typical filters
 type Filter struct {
 	Cursor   string
@@ -65,6 +133,10 @@ type Tables interface {
 	TaskResultSet(r *TaskResult)
 	TaskResultCount() int64
 	TaskResultSlice(botid string, f Filter, state TaskStateQuery, sort TaskSort) ([]TaskResult, string)
+	// TaskResultDupe loads the most recent successful TaskResult with this
+	// PropertiesHash that completed after since. Returns false if there is
+	// none.
+	TaskResultDupe(hash string, since time.Time, r *TaskResult) bool
 
 	BotGet(id string, b *Bot)
 	BotSet(b *Bot)
@@ -73,6 +145,11 @@ type Tables interface {
 
 	BotEventAdd(e *BotEvent)
 	BotEventGetSlice(botid string, f Filter) ([]BotEvent, string)
+
+	ScheduleGet(name string, s *Schedule)
+	ScheduleSet(s *Schedule)
+	ScheduleDelete(name string) bool
+	ScheduleGetSlice(cursor string, limit int) ([]Schedule, string)
 }
 
 // DB is a database backend.
@@ -130,6 +207,16 @@ func (t *TaskOutputs) SetOutput(key, offset int64, content []byte) error {
 	return o.err
 }
 
+// Truncate removes the output of a task, e.g. when it is retried.
+func (t *TaskOutputs) Truncate(key int64) error {
+	o := t.getLocked(key, 0, false)
+	if o.err == nil {
+		o.err = o.f.Truncate(0)
+	}
+	o.mu.Unlock()
+	return o.err
+}
+
 // ReadOutput reads the task output from a file at the specified offset.
 func (t *TaskOutputs) ReadOutput(key, offset int64, max int) ([]byte, error) {
 	o := t.getLocked(key, offset, true)
@@ -0,0 +1,29 @@
+package model
+
+import (
+	"io"
+	"testing"
+)
+
+func TestTaskOutputsTruncate(t *testing.T) {
+	o, err := NewTaskOutputs(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.SetOutput(1, 0, []byte("first run")); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Truncate(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = o.SetOutput(1, 0, []byte("retry")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := o.ReadOutput(1, 0, 100)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if string(got) != "retry" {
+		t.Fatalf("%q", got)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -26,6 +27,8 @@ type rawTables struct {
 
 	BotEvents      map[string][]*BotEvent
 	nextBotEventID int64
+
+	Schedules map[string]*Schedule
 }
 
 func (t *rawTables) TaskRequestGet(id int64, r *TaskRequest) {
@@ -85,8 +88,10 @@ func (t *rawTables) TaskRequestSlice(f Filter) ([]TaskRequest, string) {
 
 func (t *rawTables) TaskResultGet(id int64, r *TaskResult) {
 	t.mu.Lock()
-	// TODO(maruel): Deep copy slices. :(
-	*r = *t.TasksResult[id]
+	if d := t.TasksResult[id]; d != nil {
+		// TODO(maruel): Deep copy slices. :(
+		*r = *d
+	}
 	t.mu.Unlock()
 }
 
@@ -122,7 +127,7 @@ func (t *rawTables) BotGet(id string, b *Bot) {
 }
 
 func (t *rawTables) TaskResultSlice(botid string, f Filter, state TaskStateQuery, sort TaskSort) ([]TaskResult, string) {
-	if f.Cursor != "" || !f.Earliest.IsZero() || !f.Latest.IsZero() || state != TaskStateQueryAll || sort != TaskSortCreated {
+	if f.Cursor != "" || !f.Earliest.IsZero() || !f.Latest.IsZero() || sort != TaskSortCreated {
 		panic("implement filters")
 	}
 	if f.Limit == 0 {
@@ -136,13 +141,35 @@ func (t *rawTables) TaskResultSlice(botid string, f Filter, state TaskStateQuery
 	out := make([]TaskResult, 0, l)
 	// TODO(maruel): Copy in order.
 	for _, v := range t.TasksResult {
-		// TODO(maruel): Deep copy slices. :(
-		out = append(out, *v)
+		if len(out) == f.Limit {
+			break
+		}
+		if (botid == "" || v.BotID == botid) && state.match(v) {
+			// TODO(maruel): Deep copy slices. :(
+			out = append(out, *v)
+		}
 	}
 	t.mu.Unlock()
 	return out, ""
 }
 
+func (t *rawTables) TaskResultDupe(hash string, since time.Time, r *TaskResult) bool {
+	t.mu.Lock()
+	var found *TaskResult
+	for _, v := range t.TasksResult {
+		if v.PropertiesHash == hash && v.State == Completed && v.ExitCode == 0 && v.DedupedFrom == 0 && (found == nil || v.Key > found.Key) {
+			found = v
+		}
+	}
+	ok := found != nil && found.Completed.After(since)
+	if ok {
+		// TODO(maruel): Deep copy slices. :(
+		*r = *found
+	}
+	t.mu.Unlock()
+	return ok
+}
+
 func (t *rawTables) BotSet(b *Bot) {
 	t.mu.Lock()
 	if t.Bots[b.Key] == nil {
@@ -193,22 +220,20 @@ func (t *rawTables) BotGetSlice(cursor string, limit int) ([]Bot, string) {
 		panic("set limit")
 	}
 	t.mu.Lock()
-	l := len(t.Bots) / 2
-	if l > limit {
-		l = limit
-	}
-	b := make([]Bot, 0, l)
+	b := make([]Bot, 0, len(t.Bots))
 	for _, v := range t.Bots {
 		if v.Deleted {
 			continue
 		}
 		// TODO(maruel): Deep copy slices. :(
 		b = append(b, *v)
-		if len(b) == l {
-			break
-		}
 	}
 	t.mu.Unlock()
+	// Sort like the SQL backend so the bots returned are the same ones.
+	sort.Slice(b, func(i, j int) bool { return b[i].Key < b[j].Key })
+	if len(b) > limit {
+		b = b[:limit]
+	}
 	return b, ""
 }
 
@@ -243,11 +268,58 @@ func (t *rawTables) BotEventGetSlice(botid string, f Filter) ([]BotEvent, string
 	return b, ""
 }
 
+func (t *rawTables) ScheduleGet(name string, s *Schedule) {
+	t.mu.Lock()
+	d := t.Schedules[name]
+	if d != nil {
+		*s = *d
+	}
+	t.mu.Unlock()
+}
+
+func (t *rawTables) ScheduleSet(s *Schedule) {
+	t.mu.Lock()
+	v := &Schedule{}
+	*v = *s
+	t.Schedules[s.Key] = v
+	t.mu.Unlock()
+}
+
+func (t *rawTables) ScheduleDelete(name string) bool {
+	t.mu.Lock()
+	_, ok := t.Schedules[name]
+	delete(t.Schedules, name)
+	t.mu.Unlock()
+	return ok
+}
+
+func (t *rawTables) ScheduleGetSlice(cursor string, limit int) ([]Schedule, string) {
+	if limit == 0 {
+		panic("set limit")
+	}
+	t.mu.Lock()
+	out := make([]Schedule, 0, len(t.Schedules))
+	for k, v := range t.Schedules {
+		// The cursor is the key of the last schedule returned.
+		if k > cursor {
+			out = append(out, *v)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	if len(out) > limit {
+		out = out[:limit]
+		return out, out[limit-1].Key
+	}
+	return out, ""
+}
+
 func (t *rawTables) init() error {
 	t.TasksRequest = map[int64]*TaskRequest{}
 	t.TasksResult = map[int64]*TaskResult{}
 	t.Bots = map[string]*Bot{}
 	t.BotEvents = map[string][]*BotEvent{}
+	t.Schedules = map[string]*Schedule{}
 	return nil
 }
 
@@ -2,7 +2,10 @@ package model
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	// Force the sqlite3 driver to be registered.
 	_ "github.com/mattn/go-sqlite3"
@@ -34,17 +37,72 @@ func NewDBSqlite3(p string) (DB, error) {
 	}
 
 	// Make sure the tables are setup.
-	for _, stmt := range []string{schemaTaskRequest, schemaTaskResult, schemaBot, schemaBotEvent} {
+	fresh := false
+	if err = s.db.QueryRow("SELECT COUNT(*) = 0 FROM sqlite_master WHERE type = 'table'").Scan(&fresh); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	for _, stmt := range []string{schemaTaskRequest, schemaTaskResult, schemaBot, schemaBotEvent, schemaSchedule} {
 		if _, err = s.db.Exec(stmt); err != nil {
 			s.db.Close()
 			return nil, err
 		}
 	}
+	if err = s.migrate(fresh); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+	if _, err = s.db.Exec(schemaTaskResultIndex); err != nil {
+		s.db.Close()
+		return nil, err
+	}
 	s.db.QueryRow("SELECT key FROM TaskRequest ORDER BY key DESC").Scan(&s.lastTaskID)
 	s.db.QueryRow("SELECT key FROM BotEvent ORDER BY key DESC").Scan(&s.lastBotEventID)
 	return s, nil
 }
 
+// sqlSchemaVersion is the version of the DB schema, saved as "PRAGMA
+// user_version".
+//
+// History:
+//   - 0: initial schema.
+//   - 1: TaskResult state, exitCode, dedupedFrom and propertiesHash moved from
+//     the blob to columns.
+const sqlSchemaVersion = 1
+
+// migrate upgrades the schema of a DB created by an older version.
+//
+// A fresh DB was created with the current schema and only has its version
+// recorded.
+func (s *sqlDB) migrate(fresh bool) error {
+	v := 0
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&v); err != nil {
+		return err
+	}
+	if v == sqlSchemaVersion {
+		return nil
+	}
+	if v > sqlSchemaVersion {
+		return fmt.Errorf("DB schema version %d is newer than %d", v, sqlSchemaVersion)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if !fresh && v < 1 {
+		if err = migrateTaskResultV1(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// PRAGMA doesn't support bound parameters.
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", sqlSchemaVersion)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 func (s *sqlDB) Snapshot() error {
 	// https://sqlite.org/pragma.html#pragma_auto_vacuum
 	// TODO(maruel): VACUUM but not too often.
@@ -127,7 +185,7 @@ func (s *sqlDB) TaskRequestSlice(f Filter) ([]TaskRequest, string) {
 
 func (s *sqlDB) TaskResultGet(id int64, r *TaskResult) {
 	r2 := taskResultSQL{}
-	row := s.db.QueryRow("SELECT * FROM TaskResult WHERE key = ?", id)
+	row := s.db.QueryRow("SELECT "+taskResultColumns+" FROM TaskResult WHERE key = ?", id)
 	if err := row.Scan(r2.fields()...); err == sql.ErrNoRows {
 		return
 	} else if err != nil {
@@ -140,7 +198,7 @@ func (s *sqlDB) TaskResultGet(id int64, r *TaskResult) {
 func (s *sqlDB) TaskResultSet(r *TaskResult) {
 	r2 := taskResultSQL{}
 	r2.from(r)
-	stmt := "INSERT OR REPLACE INTO TaskResult (key, schemaVersion, botID, blob) VALUES ($1, $2, $3, $4)"
+	stmt := "INSERT OR REPLACE INTO TaskResult (" + taskResultColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
 	if _, err := s.db.Exec(stmt, r2.fields()...); err != nil {
 		panic(err)
 		return
@@ -158,20 +216,28 @@ func (s *sqlDB) TaskResultCount() int64 {
 }
 
 func (s *sqlDB) TaskResultSlice(botid string, f Filter, state TaskStateQuery, sort TaskSort) ([]TaskResult, string) {
-	if f.Cursor != "" || !f.Earliest.IsZero() || !f.Latest.IsZero() || state != TaskStateQueryAll || sort != TaskSortCreated {
+	if f.Cursor != "" || !f.Earliest.IsZero() || !f.Latest.IsZero() || sort != TaskSortCreated {
 		// TODO(maruel): pass context.
 		log.Error().Msg("TODO")
 	}
 	if f.Limit == 0 {
 		panic("set limit")
 	}
-	var rows *sql.Rows
-	var err error
+	var where []string
+	var args []interface{}
 	if botid != "" {
-		rows, err = s.db.Query("SELECT * FROM TaskResult WHERE botID = ? ORDER BY key DESC LIMIT ?", botid, f.Limit)
-	} else {
-		rows, err = s.db.Query("SELECT * FROM TaskResult ORDER BY key DESC LIMIT ?", f.Limit)
+		where = append(where, "botID = ?")
+		args = append(args, botid)
+	}
+	if w := state.sqlWhere(); w != "" {
+		where = append(where, w)
 	}
+	stmt := "SELECT " + taskResultColumns + " FROM TaskResult"
+	if len(where) != 0 {
+		stmt += " WHERE " + strings.Join(where, " AND ")
+	}
+	stmt += " ORDER BY key DESC LIMIT ?"
+	rows, err := s.db.Query(stmt, append(args, f.Limit)...)
 	if err != nil {
 		panic(err)
 	}
@@ -192,6 +258,24 @@ func (s *sqlDB) TaskResultSlice(botid string, f Filter, state TaskStateQuery, so
 	return all, ""
 }
 
+func (s *sqlDB) TaskResultDupe(hash string, since time.Time, r *TaskResult) bool {
+	r2 := taskResultSQL{}
+	row := s.db.QueryRow("SELECT "+taskResultColumns+" FROM TaskResult WHERE propertiesHash = ? AND state = ? AND exitCode = 0 AND dedupedFrom = 0 ORDER BY key DESC LIMIT 1", hash, Completed)
+	if err := row.Scan(r2.fields()...); err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		panic(err)
+		return false
+	}
+	t := TaskResult{}
+	r2.to(&t)
+	if !t.Completed.After(since) {
+		return false
+	}
+	*r = t
+	return true
+}
+
 func (s *sqlDB) BotGet(id string, b *Bot) {
 	b2 := botSQL{}
 	row := s.db.QueryRow("SELECT * FROM Bot WHERE key = ?", id)
@@ -304,3 +388,66 @@ func (s *sqlDB) BotEventGetSlice(botid string, f Filter) ([]BotEvent, string) {
 	rows.Close()
 	return all, ""
 }
+
+func (s *sqlDB) ScheduleGet(name string, d *Schedule) {
+	d2 := scheduleSQL{}
+	row := s.db.QueryRow("SELECT * FROM Schedule WHERE key = ?", name)
+	if err := row.Scan(d2.fields()...); err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		panic(err)
+		return
+	}
+	d2.to(d)
+}
+
+func (s *sqlDB) ScheduleSet(d *Schedule) {
+	d2 := scheduleSQL{}
+	d2.from(d)
+	stmt := "INSERT OR REPLACE INTO Schedule (key, schemaVersion, next, blob) VALUES ($1, $2, $3, $4)"
+	if _, err := s.db.Exec(stmt, d2.fields()...); err != nil {
+		panic(err)
+		return
+	}
+}
+
+func (s *sqlDB) ScheduleDelete(name string) bool {
+	r, err := s.db.Exec("DELETE FROM Schedule WHERE key = ?", name)
+	if err != nil {
+		panic(err)
+		return false
+	}
+	n, _ := r.RowsAffected()
+	return n != 0
+}
+
+func (s *sqlDB) ScheduleGetSlice(cursor string, limit int) ([]Schedule, string) {
+	if limit == 0 {
+		panic("set limit")
+	}
+	// The cursor is the key of the last schedule returned. Fetch one more row to
+	// know if there's a next page.
+	rows, err := s.db.Query("SELECT * FROM Schedule WHERE key > ? ORDER BY key LIMIT ?", cursor, limit+1)
+	if err != nil {
+		panic(err)
+	}
+	var all []Schedule
+	d := scheduleSQL{}
+	for rows.Next() {
+		if err := rows.Scan(d.fields()...); err != nil {
+			panic(err)
+		}
+		v := Schedule{}
+		d.to(&v)
+		all = append(all, v)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+	rows.Close()
+	if len(all) > limit {
+		all = all[:limit]
+		return all, all[limit-1].Key
+	}
+	return all, ""
+}
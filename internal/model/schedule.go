@@ -0,0 +1,112 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Schedule is a task template triggered at a later time, once or recurring.
+type Schedule struct {
+	// Key is the name of the schedule. The tasks it triggers are tagged with
+	// "schedule:<Key>".
+	Key           string    `json:"a,omitempty"`
+	SchemaVersion int       `json:"b,omitempty"`
+	Created       time.Time `json:"c,omitempty"`
+	User          string    `json:"d,omitempty"`
+	// Cron is the recurrence in cron format. Empty for a task deferred to Next.
+	Cron string `json:"e,omitempty"`
+	// Next is when the task is triggered next. It is zero once a deferred task
+	// was triggered.
+	Next time.Time `json:"f,omitempty"`
+	// Last is when the task was last triggered, LastTask the resulting task and
+	// LastError why it couldn't be created, if it failed.
+	Last      time.Time `json:"g,omitempty"`
+	LastTask  int64     `json:"h,omitempty"`
+	LastError string    `json:"i,omitempty"`
+	// Request is the API's TasksNewRequest as JSON.
+	Request []byte `json:"j,omitempty"`
+}
+
+type scheduleSQL struct {
+	key           string
+	schemaVersion int
+	next          int64
+	blob          []byte
+}
+
+func (s *scheduleSQL) fields() []interface{} {
+	return []interface{}{
+		&s.key,
+		&s.schemaVersion,
+		&s.next,
+		&s.blob,
+	}
+}
+
+func (s *scheduleSQL) from(d *Schedule) {
+	s.key = d.Key
+	s.schemaVersion = d.SchemaVersion
+	s.next = 0
+	if !d.Next.IsZero() {
+		s.next = d.Next.UnixMicro()
+	}
+	b := scheduleSQLBlob{
+		Created:   d.Created,
+		User:      d.User,
+		Cron:      d.Cron,
+		Last:      d.Last,
+		LastTask:  d.LastTask,
+		LastError: d.LastError,
+		Request:   d.Request,
+	}
+	var err error
+	s.blob, err = json.Marshal(&b)
+	if err != nil {
+		panic("internal error: " + err.Error())
+	}
+}
+
+func (s *scheduleSQL) to(d *Schedule) {
+	d.Key = s.key
+	d.SchemaVersion = s.schemaVersion
+	d.Next = time.Time{}
+	if s.next != 0 {
+		d.Next = time.UnixMicro(s.next).UTC()
+	}
+	b := scheduleSQLBlob{}
+	if err := json.Unmarshal(s.blob, &b); err != nil {
+		panic("internal error: " + err.Error())
+	}
+	d.Created = b.Created
+	d.User = b.User
+	d.Cron = b.Cron
+	d.Last = b.Last
+	d.LastTask = b.LastTask
+	d.LastError = b.LastError
+	d.Request = b.Request
+}
+
+// See:
+// - https://sqlite.org/lang_createtable.html#rowids_and_the_integer_primary_key
+// - https://sqlite.org/datatype3.html
+// BLOB
+const schemaSchedule = `
+CREATE TABLE IF NOT EXISTS Schedule (
+	key            TEXT    NOT NULL,
+	schemaVersion  INTEGER NOT NULL,
+	next           INTEGER NOT NULL,
+	blob           BLOB    NOT NULL,
+	PRIMARY KEY(key ASC)
+) STRICT;
+`
+
+// scheduleSQLBlob contains the unindexed fields.
+type scheduleSQLBlob struct {
+	Created   time.Time `json:"a,omitempty"`
+	User      string    `json:"b,omitempty"`
+	Cron      string    `json:"c,omitempty"`
+	Last      time.Time `json:"d,omitempty"`
+	LastTask  int64     `json:"e,omitempty"`
+	LastError string    `json:"f,omitempty"`
+	Request   []byte    `json:"g,omitempty"`
+}
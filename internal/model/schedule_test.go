@@ -0,0 +1,124 @@
+package model
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSchedule(t *testing.T) {
+	dbs := map[string]func(string) (DB, error){"json": NewDBJSON, "sqlite3": NewDBSqlite3}
+	for name, open := range dbs {
+		t.Run(name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "db")
+			d, err := open(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want1 := getSchedule()
+			d.ScheduleSet(want1)
+			want2 := getSchedule()
+			want2.Key = "deferred"
+			want2.Cron = ""
+			d.ScheduleSet(want2)
+			if err = d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if d, err = open(p); err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			got := Schedule{}
+			d.ScheduleGet("nightly", &got)
+			if diff := cmp.Diff(want1, &got); diff != "" {
+				t.Fatalf("(want +got):\n%s", diff)
+			}
+			all, cursor := d.ScheduleGetSlice("", 10)
+			if diff := cmp.Diff([]Schedule{*want2, *want1}, all); diff != "" {
+				t.Fatalf("(want +got):\n%s", diff)
+			}
+			if cursor != "" {
+				t.Fatal(cursor)
+			}
+			if !d.ScheduleDelete("nightly") {
+				t.Fatal("not deleted")
+			}
+			if d.ScheduleDelete("nightly") {
+				t.Fatal("deleted twice")
+			}
+			if all, _ = d.ScheduleGetSlice("", 10); len(all) != 1 || all[0].Key != "deferred" {
+				t.Fatal(all)
+			}
+		})
+	}
+}
+
+func TestScheduleGetSliceCursor(t *testing.T) {
+	dbs := map[string]func(string) (DB, error){"json": NewDBJSON, "sqlite3": NewDBSqlite3}
+	for name, open := range dbs {
+		t.Run(name, func(t *testing.T) {
+			d, err := open(filepath.Join(t.TempDir(), "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			for _, k := range []string{"e", "a", "d", "b", "c"} {
+				s := getSchedule()
+				s.Key = k
+				d.ScheduleSet(s)
+			}
+			data := []struct {
+				cursor string
+				limit  int
+				want   []string
+				next   string
+			}{
+				{"", 2, []string{"a", "b"}, "b"},
+				{"b", 2, []string{"c", "d"}, "d"},
+				{"d", 2, []string{"e"}, ""},
+				{"", 5, []string{"a", "b", "c", "d", "e"}, ""},
+				{"", 4, []string{"a", "b", "c", "d"}, "d"},
+				{"d", 1, []string{"e"}, ""},
+				{"e", 2, nil, ""},
+				// The cursor doesn't have to be an existing key.
+				{"bb", 10, []string{"c", "d", "e"}, ""},
+			}
+			for i, l := range data {
+				all, next := d.ScheduleGetSlice(l.cursor, l.limit)
+				var got []string
+				for _, s := range all {
+					got = append(got, s.Key)
+				}
+				if !reflect.DeepEqual(l.want, got) || l.next != next {
+					t.Errorf("#%d: want %v %q, got %v %q", i, l.want, l.next, got, next)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleNonZero(t *testing.T) {
+	s := getSchedule()
+	if err := isNonZero("", reflect.ValueOf(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getSchedule() *Schedule {
+	return &Schedule{
+		Key:           "nightly",
+		SchemaVersion: 1,
+		Created:       time.Date(2020, 1, 13, 10, 9, 8, 7000, time.UTC),
+		User:          "joe@example.com",
+		Cron:          "0 3 * * *",
+		Next:          time.Date(2020, 1, 15, 3, 0, 0, 0, time.UTC),
+		Last:          time.Date(2020, 1, 14, 3, 0, 0, 0, time.UTC),
+		LastTask:      3,
+		LastError:     "quota exceeded",
+		Request:       []byte(`{"name":"maintenance"}`),
+	}
+}
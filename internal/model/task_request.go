@@ -1,6 +1,7 @@
 package model
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -51,8 +52,10 @@ func (t *TaskRequest) ValidateAndSetDefaults() error {
 		tags[n] = struct{}{}
 	}
 	for i := range t.TaskSlices {
-		for k, v := range t.TaskSlices[i].Properties.Dimensions {
-			tags[k+":"+v] = struct{}{}
+		for k, values := range t.TaskSlices[i].Properties.Dimensions {
+			for _, v := range values {
+				tags[k+":"+v] = struct{}{}
+			}
 		}
 		// TODO(maruel): Expiration has to be checked here.
 		if err := t.TaskSlices[i].ValidateAndSetDefaults(); err != nil {
@@ -75,17 +78,33 @@ type TaskID string
 func ToTaskID(key int64) TaskID {
 	// Swarming uses the last nibbles:
 	// - schema version, used 0 and 1. mess uses 2.
-	// - retries, used 0, 1 and 2. mess uses 0
+	// - retries, used 0, 1 and 2. 0 is the task itself, 1 and 2 are the runs.
+	//   mess uses up to MaxTryNumber since the preempted runs are tries too.
 	if key <= 0 {
 		return ""
 	}
 	return TaskID(strconv.FormatInt(key, 10) + "20")
 }
 
+// MaxTryNumber is the maximum number of runs of a task, so the try number fits
+// in the last digit of a run ID.
+const MaxTryNumber = 9
+
+// ToRunID converts an internal DB key and a try number to the external format
+// of a run.
+func ToRunID(key int64, try int32) TaskID {
+	if key <= 0 || try < 1 || try > MaxTryNumber {
+		return ""
+	}
+	return TaskID(strconv.FormatInt(key, 10) + "2" + strconv.Itoa(int(try)))
+}
+
 // FromTaskID converts an external key to the internal DB format.
+//
+// It accepts both task IDs and run IDs.
 func FromTaskID(t TaskID) int64 {
 	l := len(t)
-	if l < 3 || t[l-2:l] != "20" {
+	if l < 3 || t[l-2] != '2' || t[l-1] < '0' || t[l-1] > '0'+MaxTryNumber {
 		return 0
 	}
 	v, _ := strconv.ParseInt(string(t[:l-2]), 10, 64)
@@ -95,6 +114,14 @@ func FromTaskID(t TaskID) int64 {
 	return v
 }
 
+// TryNumber returns the try number of a run ID, or 0 for a task ID.
+func TryNumber(t TaskID) int32 {
+	if FromTaskID(t) == 0 {
+		return 0
+	}
+	return int32(t[len(t)-1] - '0')
+}
+
 type taskRequestSQL struct {
 	key           int64
 	schemaVersion int64
@@ -257,7 +284,7 @@ type TaskProperties struct {
 	CIPDHost     string              `json:"f,omitempty"`
 	CIPDClient   CIPDPackage         `json:"g,omitempty"`
 	CIPDPackages []CIPDPackage       `json:"h,omitempty"`
-	Dimensions   map[string]string   `json:"i,omitempty"`
+	Dimensions   map[string][]string `json:"i,omitempty"`
 	Env          map[string]string   `json:"j,omitempty"`
 	EnvPrefixes  map[string][]string `json:"k,omitempty"`
 	HardTimeout  time.Duration       `json:"l,omitempty"`
@@ -269,6 +296,45 @@ type TaskProperties struct {
 	Containment  Containment         `json:"r,omitempty"`
 }
 
+// UnmarshalJSON decodes the properties, accepting the dimensions saved before
+// they supported repeated keys, as a map of string.
+func (t *TaskProperties) UnmarshalJSON(b []byte) error {
+	type alias TaskProperties
+	a := struct {
+		*alias
+		Dimensions json.RawMessage `json:"i,omitempty"`
+	}{alias: (*alias)(t)}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	t.Dimensions = nil
+	if len(a.Dimensions) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(a.Dimensions, &t.Dimensions); err == nil {
+		return nil
+	}
+	old := map[string]string{}
+	if err := json.Unmarshal(a.Dimensions, &old); err != nil {
+		return err
+	}
+	t.Dimensions = make(map[string][]string, len(old))
+	for k, v := range old {
+		t.Dimensions[k] = []string{v}
+	}
+	return nil
+}
+
+// Hash returns the hash of the properties, used to dedupe idempotent tasks.
+func (t *TaskProperties) Hash() string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		panic("internal error: " + err.Error())
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
 // ValidateAndSetDefaults set default values and returns an error if the task
 // request is invalid.
 func (t *TaskProperties) ValidateAndSetDefaults() error {
@@ -283,6 +349,48 @@ func (t *TaskProperties) ValidateAndSetDefaults() error {
 		t.CIPDClient.Version = "git_revision:8e9b0c80860d00dfe951f7ea37d74e210d376c13"
 		t.CIPDClient.Path = ""
 	}
+	return validateDimensions(t.Dimensions)
+}
+
+// maxORDimensions is the maximum number of combinations of OR dimensions
+// within a task slice, like Swarming.
+const maxORDimensions = 8
+
+// validateDimensions returns an error if the requested dimensions are invalid.
+//
+// A key can have multiple values, in which case a bot must have all of them.
+// A value can be alternatives separated by "|", in which case a bot must have
+// any of them. The values are sorted in place.
+func validateDimensions(dims map[string][]string) error {
+	combinations := 1
+	for k, values := range dims {
+		if k == "" || strings.ContainsAny(k, ":|") {
+			return fmt.Errorf("invalid dimension key %q", k)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("dimension %q has no value", k)
+		}
+		sort.Strings(values)
+		for i, v := range values {
+			if i != 0 && v == values[i-1] {
+				return fmt.Errorf("dimension %s:%s is duplicated", k, v)
+			}
+			alts := strings.Split(v, "|")
+			for j, a := range alts {
+				if a == "" {
+					return fmt.Errorf("invalid dimension value %s:%s", k, v)
+				}
+				for _, b := range alts[:j] {
+					if a == b {
+						return fmt.Errorf("dimension %s:%s has duplicated alternatives", k, v)
+					}
+				}
+			}
+			if combinations *= len(alts); combinations > maxORDimensions {
+				return fmt.Errorf("too many OR dimension combinations; max %d", maxORDimensions)
+			}
+		}
+	}
 	return nil
 }
 
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"path/filepath"
@@ -134,7 +135,7 @@ func getTaskRequest() *TaskRequest {
 							Path:    "pkgpath",
 						},
 					},
-					Dimensions:  map[string]string{"os": "Windows"},
+					Dimensions:  map[string][]string{"os": {"Windows"}},
 					Env:         map[string]string{"FOO": "bar"},
 					EnvPrefixes: map[string][]string{"PATH": {"./foo"}},
 					HardTimeout: time.Minute,
@@ -227,3 +228,90 @@ func isNonZero(prefix string, v reflect.Value) error {
 	}
 	return nil
 }
+
+func TestTaskID(t *testing.T) {
+	data := []struct {
+		id  TaskID
+		key int64
+		try int32
+	}{
+		{"120", 1, 0},
+		{"121", 1, 1},
+		{"4222", 42, 2},
+		{"123", 1, 3},
+		{"129", 1, 9},
+		{"12a", 0, 0},
+		{"110", 0, 0},
+		{"20", 0, 0},
+	}
+	for i, l := range data {
+		if key := FromTaskID(l.id); key != l.key {
+			t.Fatalf("#%d: %d != %d", i, l.key, key)
+		}
+		if try := TryNumber(l.id); try != l.try {
+			t.Fatalf("#%d: %d != %d", i, l.try, try)
+		}
+	}
+	if id := ToTaskID(1); id != "120" {
+		t.Fatal(id)
+	}
+	if id := ToRunID(42, 2); id != "4222" {
+		t.Fatal(id)
+	}
+	if id := ToRunID(42, 0); id != "" {
+		t.Fatal(id)
+	}
+	if id := ToRunID(42, MaxTryNumber+1); id != "" {
+		t.Fatal(id)
+	}
+}
+
+func TestValidateDimensions(t *testing.T) {
+	good := map[string][]string{"os": {"Windows", "Windows-11"}, "pool": {"a|b"}}
+	if err := validateDimensions(good); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		dims map[string][]string
+		err  string
+	}{
+		{map[string][]string{"": {"a"}}, "invalid dimension key \"\""},
+		{map[string][]string{"a:b": {"a"}}, "invalid dimension key \"a:b\""},
+		{map[string][]string{"os": nil}, "dimension \"os\" has no value"},
+		{map[string][]string{"os": {"a", "a"}}, "dimension os:a is duplicated"},
+		{map[string][]string{"os": {"a|"}}, "invalid dimension value os:a|"},
+		{map[string][]string{"os": {"a|b|a"}}, "dimension os:a|b|a has duplicated alternatives"},
+		{map[string][]string{"os": {"a|b|c"}, "gpu": {"a|b|c"}}, "too many OR dimension combinations; max 8"},
+	}
+	for i, l := range data {
+		if err := validateDimensions(l.dims); err == nil || err.Error() != l.err {
+			t.Errorf("#%d: %v", i, err)
+		}
+	}
+}
+
+func TestTaskRequestBaselineDimensions(t *testing.T) {
+	// Blob written before the dimensions supported repeated keys.
+	r := taskRequestSQL{tags: ";os:Linux;pool:default;", blob: []byte(`{"a":[{"a":{"b":["echo"],"i":{"os":"Linux","pool":"default"}}}],"b":"task"}`)}
+	got := TaskRequest{}
+	r.to(&got)
+	want := map[string][]string{"os": {"Linux"}, "pool": {"default"}}
+	if diff := cmp.Diff(want, got.TaskSlices[0].Properties.Dimensions); diff != "" {
+		t.Fatalf("(want +got):\n%s", diff)
+	}
+	if got.Name != "task" || len(got.TaskSlices[0].Properties.Command) != 1 {
+		t.Fatal(got)
+	}
+
+	// The current format round trips.
+	p := TaskProperties{}
+	if err := json.Unmarshal([]byte(`{"i":{"os":["Linux","Ubuntu"]}}`), &p); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string][]string{"os": {"Linux", "Ubuntu"}}, p.Dimensions); diff != "" {
+		t.Fatalf("(want +got):\n%s", diff)
+	}
+	if err := json.Unmarshal([]byte(`{"i":{"os":1}}`), &p); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"database/sql"
 	"encoding/json"
 	"time"
 )
@@ -34,13 +35,21 @@ type TaskResult struct {
 	Cost             float64             `json:"y,omitempty"`
 	Killing          bool                `json:"z,omitempty"`
 	DeadAfter        time.Time           `json:"aa,omitempty"`
+	TryNumber        int32               `json:"ab,omitempty"`
+	PreviousRuns     []TaskRun           `json:"ac,omitempty"`
+	PreemptedBy      int64               `json:"ad,omitempty"`
+	Perf             TaskPerfStats       `json:"ae,omitempty"`
 }
 
 type taskResultSQL struct {
-	key           int64
-	schemaVersion int
-	botID         string
-	blob          []byte
+	key            int64
+	schemaVersion  int
+	botID          string
+	state          TaskState
+	exitCode       int32
+	dedupedFrom    int64
+	propertiesHash string
+	blob           []byte
 }
 
 func (r *taskResultSQL) fields() []interface{} {
@@ -48,6 +57,10 @@ func (r *taskResultSQL) fields() []interface{} {
 		&r.key,
 		&r.schemaVersion,
 		&r.botID,
+		&r.state,
+		&r.exitCode,
+		&r.dedupedFrom,
+		&r.propertiesHash,
 		&r.blob,
 	}
 }
@@ -56,18 +69,18 @@ func (r *taskResultSQL) from(t *TaskResult) {
 	r.key = t.Key
 	r.schemaVersion = t.SchemaVersion
 	r.botID = t.BotID
+	r.state = t.State
+	r.exitCode = t.ExitCode
+	r.dedupedFrom = t.DedupedFrom
+	r.propertiesHash = t.PropertiesHash
 	b := taskResultSQLBlob{
 		BotVersion:       t.BotVersion,
 		BotDimensions:    t.BotDimensions,
 		BotIdleSince:     t.BotIdleSince,
 		ServerVersions:   t.ServerVersions,
 		CurrentTaskSlice: t.CurrentTaskSlice,
-		DedupedFrom:      t.DedupedFrom,
-		PropertiesHash:   t.PropertiesHash,
 		TaskOutput:       t.TaskOutput,
-		ExitCode:         t.ExitCode,
 		InternalFailure:  t.InternalFailure,
-		State:            t.State,
 		Children:         t.Children,
 		Output:           t.Output,
 		CIPDClientUsed:   t.CIPDClientUsed,
@@ -81,6 +94,10 @@ func (r *taskResultSQL) from(t *TaskResult) {
 		Cost:             t.Cost,
 		Killing:          t.Killing,
 		DeadAfter:        t.DeadAfter,
+		TryNumber:        t.TryNumber,
+		PreviousRuns:     t.PreviousRuns,
+		PreemptedBy:      t.PreemptedBy,
+		Perf:             t.Perf,
 	}
 	var err error
 	r.blob, err = json.Marshal(&b)
@@ -93,6 +110,10 @@ func (r *taskResultSQL) to(t *TaskResult) {
 	t.Key = r.key
 	t.SchemaVersion = r.schemaVersion
 	t.BotID = r.botID
+	t.State = r.state
+	t.ExitCode = r.exitCode
+	t.DedupedFrom = r.dedupedFrom
+	t.PropertiesHash = r.propertiesHash
 	b := taskResultSQLBlob{}
 	if err := json.Unmarshal(r.blob, &b); err != nil {
 		panic("internal error: " + err.Error())
@@ -102,12 +123,8 @@ func (r *taskResultSQL) to(t *TaskResult) {
 	t.BotIdleSince = b.BotIdleSince
 	t.ServerVersions = b.ServerVersions
 	t.CurrentTaskSlice = b.CurrentTaskSlice
-	t.DedupedFrom = b.DedupedFrom
-	t.PropertiesHash = b.PropertiesHash
 	t.TaskOutput = b.TaskOutput
-	t.ExitCode = b.ExitCode
 	t.InternalFailure = b.InternalFailure
-	t.State = b.State
 	t.Children = b.Children
 	t.Output = b.Output
 	t.CIPDClientUsed = b.CIPDClientUsed
@@ -121,35 +138,111 @@ func (r *taskResultSQL) to(t *TaskResult) {
 	t.Cost = b.Cost
 	t.Killing = b.Killing
 	t.DeadAfter = b.DeadAfter
+	t.TryNumber = b.TryNumber
+	t.PreviousRuns = b.PreviousRuns
+	t.PreemptedBy = b.PreemptedBy
+	t.Perf = b.Perf
 }
 
+// taskResultColumns lists the columns in the order of taskResultSQL.fields().
+//
+// The columns added by migrateTaskResultV1 are after blob in a migrated DB so
+// "SELECT *" must not be used.
+const taskResultColumns = "key, schemaVersion, botID, state, exitCode, dedupedFrom, propertiesHash, blob"
+
 // See:
 // - https://sqlite.org/lang_createtable.html#rowids_and_the_integer_primary_key
 // - https://sqlite.org/datatype3.html
 // BLOB
 const schemaTaskResult = `
 CREATE TABLE IF NOT EXISTS TaskResult (
-	key           INTEGER NOT NULL,
-	schemaVersion INTEGER NOT NULL,
-	botID         TEXT NOT NULL,
-	blob          BLOB    NOT NULL,
+	key            INTEGER NOT NULL,
+	schemaVersion  INTEGER NOT NULL,
+	botID          TEXT NOT NULL,
+	state          INTEGER NOT NULL,
+	exitCode       INTEGER NOT NULL,
+	dedupedFrom    INTEGER NOT NULL,
+	propertiesHash TEXT NOT NULL,
+	blob           BLOB    NOT NULL,
 	PRIMARY KEY(key DESC)
 ) STRICT;
 `
 
+// schemaTaskResultIndex must be run after the migrations, since the column
+// doesn't exist in older DBs.
+const schemaTaskResultIndex = `
+CREATE INDEX IF NOT EXISTS TaskResultPropertiesHash ON TaskResult(propertiesHash) WHERE propertiesHash != '';
+`
+
+// migrateTaskResultV1 moves the fields used in queries from the blob to
+// columns.
+func migrateTaskResultV1(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		"ALTER TABLE TaskResult ADD COLUMN state INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE TaskResult ADD COLUMN exitCode INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE TaskResult ADD COLUMN dedupedFrom INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE TaskResult ADD COLUMN propertiesHash TEXT NOT NULL DEFAULT ''",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	rows, err := tx.Query("SELECT key, blob FROM TaskResult")
+	if err != nil {
+		return err
+	}
+	type row struct {
+		key int64
+		b   taskResultSQLBlobV0
+	}
+	var all []row
+	for rows.Next() {
+		var r row
+		var blob []byte
+		if err = rows.Scan(&r.key, &blob); err != nil {
+			rows.Close()
+			return err
+		}
+		if err = json.Unmarshal(blob, &r.b); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	stmt := "UPDATE TaskResult SET state = $1, exitCode = $2, dedupedFrom = $3, propertiesHash = $4 WHERE key = $5"
+	for _, r := range all {
+		if _, err = tx.Exec(stmt, r.b.State, r.b.ExitCode, r.b.DedupedFrom, r.b.PropertiesHash, r.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskResultSQLBlobV0 contains the fields that were in the blob before
+// migrateTaskResultV1.
+type taskResultSQLBlobV0 struct {
+	DedupedFrom    int64     `json:"f,omitempty"`
+	PropertiesHash string    `json:"g,omitempty"`
+	ExitCode       int32     `json:"i,omitempty"`
+	State          TaskState `json:"k,omitempty"`
+}
+
 // taskResultSQLBlob contains the unindexed fields.
+//
+// The keys "f", "g", "i" and "k" were used by fields now saved as columns and
+// must not be reused. See taskResultSQLBlobV0.
 type taskResultSQLBlob struct {
 	BotVersion       string              `json:"a,omitempty"`
 	BotDimensions    map[string][]string `json:"b,omitempty"`
 	BotIdleSince     time.Duration       `json:"c,omitempty"`
 	ServerVersions   []string            `json:"d,omitempty"`
 	CurrentTaskSlice int32               `json:"e,omitempty"`
-	DedupedFrom      int64               `json:"f,omitempty"`
-	PropertiesHash   string              `json:"g,omitempty"`
 	TaskOutput       TaskOutput          `json:"h,omitempty"`
-	ExitCode         int32               `json:"i,omitempty"`
 	InternalFailure  string              `json:"j,omitempty"`
-	State            TaskState           `json:"k,omitempty"`
 	Children         []int64             `json:"l,omitempty"`
 	Output           Digest              `json:"m,omitempty"`
 	CIPDClientUsed   CIPDPackage         `json:"n,omitempty"`
@@ -163,6 +256,10 @@ type taskResultSQLBlob struct {
 	Cost             float64             `json:"v,omitempty"`
 	Killing          bool                `json:"w,omitempty"`
 	DeadAfter        time.Time           `json:"x,omitempty"`
+	TryNumber        int32               `json:"y,omitempty"`
+	PreviousRuns     []TaskRun           `json:"z,omitempty"`
+	PreemptedBy      int64               `json:"aa,omitempty"`
+	Perf             TaskPerfStats       `json:"ab,omitempty"`
 }
 
 // TaskState is the state of the task request.
@@ -179,8 +276,23 @@ const (
 	Completed
 	Killed
 	NoResource
+	// Preempted is only used for a previous run that was killed to run a task
+	// with a higher priority. The task itself is requeued.
+	Preempted
 )
 
+// TaskRun is a previous attempt at running a task that was retried.
+type TaskRun struct {
+	TryNumber       int32               `json:"a,omitempty"`
+	BotID           string              `json:"b,omitempty"`
+	BotVersion      string              `json:"c,omitempty"`
+	BotDimensions   map[string][]string `json:"d,omitempty"`
+	State           TaskState           `json:"e,omitempty"`
+	InternalFailure string              `json:"f,omitempty"`
+	Started         time.Time           `json:"g,omitempty"`
+	Abandoned       time.Time           `json:"h,omitempty"`
+}
+
 // ResultDB declares the LUCI ResultDB information.
 type ResultDB struct {
 	Host       string `json:"a,omitempty"`
@@ -191,3 +303,27 @@ type ResultDB struct {
 type TaskOutput struct {
 	Size int64 `json:"a,omitempty"`
 }
+
+// TaskPerfStats is the performance stats reported by the bot for a task.
+type TaskPerfStats struct {
+	BotOverhead          time.Duration     `json:"a,omitempty"`
+	CASDownload          CASOperationStats `json:"b,omitempty"`
+	CASUpload            CASOperationStats `json:"c,omitempty"`
+	PkgInstallation      time.Duration     `json:"d,omitempty"`
+	CacheTrim            time.Duration     `json:"e,omitempty"`
+	NamedCachesInstall   time.Duration     `json:"f,omitempty"`
+	NamedCachesUninstall time.Duration     `json:"g,omitempty"`
+	Cleanup              time.Duration     `json:"h,omitempty"`
+}
+
+// CASOperationStats is the stats of a RBE-CAS download or upload.
+type CASOperationStats struct {
+	Duration        time.Duration `json:"a,omitempty"`
+	InitialNumItems int64         `json:"b,omitempty"`
+	InitialSize     int64         `json:"c,omitempty"`
+	// ItemsCold and ItemsHot are zlib deflated varints of the items sizes.
+	ItemsCold    []byte `json:"d,omitempty"`
+	ItemsHot     []byte `json:"e,omitempty"`
+	NumItemsCold int64  `json:"f,omitempty"`
+	NumItemsHot  int64  `json:"g,omitempty"`
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"database/sql"
 	"path/filepath"
 	"reflect"
 	"testing"
@@ -88,6 +89,84 @@ func TestTaskResultSQL(t *testing.T) {
 	}
 }
 
+func TestTaskResultSQLMigration(t *testing.T) {
+	// Create a DB with the schema and blob of version 0.
+	p := filepath.Join(t.TempDir(), "mess.db")
+	c, err := sql.Open("sqlite3", "file:"+p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := `
+CREATE TABLE TaskResult (
+	key           INTEGER NOT NULL,
+	schemaVersion INTEGER NOT NULL,
+	botID         TEXT NOT NULL,
+	blob          BLOB    NOT NULL,
+	PRIMARY KEY(key DESC)
+) STRICT;
+`
+	if _, err = c.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	completed := time.Date(2020, 2, 13, 10, 9, 8, 7000, time.UTC)
+	blob := `{"a":"version1","f":2134,"g":"abc","h":{"a":1000},"i":128,"j":"blew up","k":6,"o":[{"a":"pkg1"}],"s":"2020-02-13T10:09:08.000007Z"}`
+	if _, err = c.Exec("INSERT INTO TaskResult VALUES (2, 1, 'bot1', ?)", []byte(blob)); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDBSqlite3(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := TaskResult{}
+	d.TaskResultGet(2, &got)
+	want := TaskResult{
+		Key:             2,
+		SchemaVersion:   1,
+		BotID:           "bot1",
+		BotVersion:      "version1",
+		DedupedFrom:     2134,
+		PropertiesHash:  "abc",
+		TaskOutput:      TaskOutput{Size: 1000},
+		ExitCode:        128,
+		InternalFailure: "blew up",
+		State:           Completed,
+		CIPDPins:        []CIPDPackage{{PkgName: "pkg1"}},
+		Completed:       completed,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("(want +got):\n%s", diff)
+	}
+	// The new columns are queryable.
+	if l, _ := d.TaskResultSlice("", Filter{Limit: 10}, TaskStateQueryCompletedFailure, TaskSortCreated); len(l) != 1 {
+		t.Fatal(l)
+	}
+	want.Key = 3
+	want.ExitCode = 0
+	want.DedupedFrom = 0
+	d.TaskResultSet(&want)
+	if !d.TaskResultDupe("abc", completed.Add(-time.Hour), &got) || got.Key != 3 {
+		t.Fatal(got.Key)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening it again doesn't migrate again.
+	if d, err = NewDBSqlite3(p); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.TaskResultCount(); l != 2 {
+		t.Fatal(l)
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestTaskResultNonZero(t *testing.T) {
 	r := getTaskResult()
 	if err := isNonZero("", reflect.ValueOf(r)); err != nil {
@@ -99,6 +178,61 @@ func TestTaskResultNonZero(t *testing.T) {
 	}
 }
 
+func TestTaskResultGetUnknown(t *testing.T) {
+	dbs := map[string]func(string) (DB, error){"json": NewDBJSON, "sqlite3": NewDBSqlite3}
+	for name, open := range dbs {
+		t.Run(name, func(t *testing.T) {
+			d, err := open(filepath.Join(t.TempDir(), "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			got := TaskResult{}
+			if d.TaskResultGet(42, &got); got.Key != 0 {
+				t.Fatal(got.Key)
+			}
+		})
+	}
+}
+
+func TestTaskResultDupe(t *testing.T) {
+	dbs := map[string]func(string) (DB, error){"json": NewDBJSON, "sqlite3": NewDBSqlite3}
+	for name, open := range dbs {
+		t.Run(name, func(t *testing.T) {
+			d, err := open(filepath.Join(t.TempDir(), "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			completed := time.Date(2020, 2, 13, 10, 9, 8, 7000, time.UTC)
+			d.TaskResultSet(&TaskResult{Key: 1, PropertiesHash: "abc", State: Completed, Completed: completed})
+			d.TaskResultSet(&TaskResult{Key: 2, PropertiesHash: "abc", State: Completed, ExitCode: 1, Completed: completed})
+			d.TaskResultSet(&TaskResult{Key: 3, DedupedFrom: 1, State: Completed, Completed: completed})
+			d.TaskResultSet(&TaskResult{Key: 4, PropertiesHash: "abc", State: Running})
+			got := TaskResult{}
+			if !d.TaskResultDupe("abc", completed.Add(-time.Hour), &got) || got.Key != 1 {
+				t.Fatal(got.Key)
+			}
+			if d.TaskResultDupe("abc", completed, &got) {
+				t.Fatal("too old")
+			}
+			if d.TaskResultDupe("def", time.Time{}, &got) {
+				t.Fatal("unknown hash")
+			}
+			f := Filter{Limit: 10}
+			if l, _ := d.TaskResultSlice("", f, TaskStateQueryDeduped, TaskSortCreated); len(l) != 1 || l[0].Key != 3 {
+				t.Fatal(l)
+			}
+			if l, _ := d.TaskResultSlice("", f, TaskStateQueryCompletedFailure, TaskSortCreated); len(l) != 1 || l[0].Key != 2 {
+				t.Fatal(l)
+			}
+			if l, _ := d.TaskResultSlice("", f, TaskStateQueryAll, TaskSortCreated); len(l) != 4 {
+				t.Fatal(l)
+			}
+		})
+	}
+}
+
 func getTaskResult() *TaskResult {
 	return &TaskResult{
 		SchemaVersion:    1,
@@ -146,5 +280,45 @@ func getTaskResult() *TaskResult {
 		Cost:      100.2,
 		Killing:   true,
 		DeadAfter: time.Date(2020, 5, 13, 10, 9, 8, 7000, time.UTC),
+		TryNumber: 2,
+		PreviousRuns: []TaskRun{
+			{
+				TryNumber:       1,
+				BotID:           "bot0",
+				BotVersion:      "version0",
+				BotDimensions:   map[string][]string{"a": {"b"}},
+				State:           BotDied,
+				InternalFailure: "bot died",
+				Started:         time.Date(2020, 1, 12, 10, 9, 8, 7000, time.UTC),
+				Abandoned:       time.Date(2020, 1, 12, 11, 9, 8, 7000, time.UTC),
+			},
+		},
+		PreemptedBy: 5,
+		Perf: TaskPerfStats{
+			BotOverhead: time.Second,
+			CASDownload: CASOperationStats{
+				Duration:        2 * time.Second,
+				InitialNumItems: 10,
+				InitialSize:     1000,
+				ItemsCold:       []byte{1},
+				ItemsHot:        []byte{2},
+				NumItemsCold:    1,
+				NumItemsHot:     2,
+			},
+			CASUpload: CASOperationStats{
+				Duration:        3 * time.Second,
+				InitialNumItems: 11,
+				InitialSize:     1001,
+				ItemsCold:       []byte{3},
+				ItemsHot:        []byte{4},
+				NumItemsCold:    3,
+				NumItemsHot:     4,
+			},
+			PkgInstallation:      4 * time.Second,
+			CacheTrim:            5 * time.Second,
+			NamedCachesInstall:   6 * time.Second,
+			NamedCachesUninstall: 7 * time.Second,
+			Cleanup:              8 * time.Second,
+		},
 	}
 }
@@ -96,6 +96,18 @@ type BotTasksResponse struct {
 	Now    Time         `json:"now,omitempty"`
 }
 
+// BotRestartRequest is /bot/<id>/restart (POST).
+//
+// It is specific to mess. The bot restarts on its next poll.
+type BotRestartRequest struct {
+	Message string `json:"message"`
+}
+
+// BotRestartResponse is /bot/<id>/restart (POST).
+type BotRestartResponse struct {
+	Ok bool `json:"ok"`
+}
+
 // BotTerminateResponse is /bot/<id>/terminate (POST).
 type BotTerminateResponse struct {
 	TaskID model.TaskID `json:"task_id,omitempty"`
@@ -26,7 +26,7 @@ func CloudTime(t time.Time) Time {
 type Int string
 
 func (i Int) Int32() int32 {
-	v, err := strconv.ParseInt(string(i), 32, 10)
+	v, err := strconv.ParseInt(string(i), 10, 32)
 	if err != nil {
 		return 0
 	}
@@ -34,19 +34,19 @@ func (i Int) Int32() int32 {
 }
 
 func (i Int) Int64() int64 {
-	v, err := strconv.ParseInt(string(i), 64, 10)
+	v, err := strconv.ParseInt(string(i), 10, 64)
 	if err != nil {
 		return 0
 	}
 	return v
 }
 
-func (i Int) Set32(v int32) {
-	i = Int(strconv.FormatInt(int64(v), 10))
+func (i *Int) Set32(v int32) {
+	*i = Int(strconv.FormatInt(int64(v), 10))
 }
 
-func (i Int) Set64(v int64) {
-	i = Int(strconv.FormatInt(v, 10))
+func (i *Int) Set64(v int64) {
+	*i = Int(strconv.FormatInt(v, 10))
 }
 
 // StringPair is a key value item.
@@ -75,6 +75,33 @@ func FromStringPairs(d []StringPair) map[string]string {
 	return out
 }
 
+// ToRepeatedStringPairs flattens the values as pairs, repeating the key for
+// each value.
+func ToRepeatedStringPairs(d map[string][]string) []StringPair {
+	var out []StringPair
+	for k, values := range d {
+		for _, v := range values {
+			out = append(out, StringPair{Key: k, Value: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Key != out[j].Key {
+			return out[i].Key < out[j].Key
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
+
+// FromRepeatedStringPairs groups the values of repeated keys.
+func FromRepeatedStringPairs(d []StringPair) map[string][]string {
+	out := make(map[string][]string, len(d))
+	for i := range d {
+		out[d[i].Key] = append(out[d[i].Key], d[i].Value)
+	}
+	return out
+}
+
 // StringListPair is a key values item.
 type StringListPair struct {
 	Key    string   `json:"key"`
@@ -134,7 +161,7 @@ func ToInt64(v string, def int64) int64 {
 	if v == "" {
 		return def
 	}
-	i, err := strconv.ParseInt(v, 64, 10)
+	i, err := strconv.ParseInt(v, 10, 64)
 	if err != nil {
 		return def
 	}
@@ -0,0 +1,81 @@
+package messapi
+
+import (
+	"encoding/json"
+
+	"github.com/maruel/mess/internal/model"
+)
+
+// Schedules are specific to mess. They are task templates triggered at a
+// later time, once or recurring.
+
+// Schedule is a task template triggered by the server.
+type Schedule struct {
+	Name string `json:"name"`
+	// Cron is the recurrence in cron format, in UTC. Empty for a deferred task.
+	Cron       string          `json:"cron,omitempty"`
+	CreatedTS  Time            `json:"created_ts,omitempty"`
+	User       string          `json:"user,omitempty"`
+	NextTS     Time            `json:"next_ts,omitempty"`
+	LastTS     Time            `json:"last_ts,omitempty"`
+	LastTaskID model.TaskID    `json:"last_task_id,omitempty"`
+	LastError  string          `json:"last_error,omitempty"`
+	Request    TasksNewRequest `json:"request"`
+}
+
+// FromDB converts the model to the API.
+func (s *Schedule) FromDB(m *model.Schedule) {
+	s.Name = m.Key
+	s.Cron = m.Cron
+	s.CreatedTS = CloudTime(m.Created)
+	s.User = m.User
+	s.NextTS = CloudTime(m.Next)
+	s.LastTS = CloudTime(m.Last)
+	s.LastTaskID = ""
+	if m.LastTask != 0 {
+		s.LastTaskID = model.ToTaskID(m.LastTask)
+	}
+	s.LastError = m.LastError
+	s.Request = TasksNewRequest{}
+	_ = json.Unmarshal(m.Request, &s.Request)
+}
+
+// SchedulesListRequest is /schedules/list (GET).
+type SchedulesListRequest struct {
+	Limit  int64
+	Cursor string
+}
+
+// SchedulesListResponse is /schedules/list (GET).
+type SchedulesListResponse struct {
+	Cursor string     `json:"cursor,omitempty"`
+	Items  []Schedule `json:"items,omitempty"`
+	Now    Time       `json:"now,omitempty"`
+}
+
+// SchedulesNewRequest is /schedules/new (POST).
+//
+// Exactly one of Cron or At must be set.
+type SchedulesNewRequest struct {
+	Name string `json:"name"`
+	Cron string `json:"cron"`
+	// At is when to trigger a deferred task, in seconds since epoch.
+	At      float64         `json:"at"`
+	Request TasksNewRequest `json:"request"`
+}
+
+// SchedulesNewResponse is /schedules/new (POST).
+type SchedulesNewResponse struct {
+	Schedule Schedule `json:"schedule"`
+	Now      Time     `json:"now,omitempty"`
+}
+
+// SchedulesDeleteRequest is /schedules/delete (POST).
+type SchedulesDeleteRequest struct {
+	Name string `json:"name"`
+}
+
+// SchedulesDeleteResponse is /schedules/delete (POST).
+type SchedulesDeleteResponse struct {
+	Deleted bool `json:"deleted"`
+}
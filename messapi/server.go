@@ -34,3 +34,30 @@ type ServerPermissionsResponse struct {
 	ListBots    []string `json:"list_bots"`
 	ListTasks   []string `json:"list_tasks"`
 }
+
+// ServerTokenResponse is /server/token (POST).
+//
+// The token authenticates a bot for an hour, e.g. to download the bot code
+// with /bot_code?tok=<token>.
+type ServerTokenResponse struct {
+	BootstrapToken string `json:"bootstrap_token"`
+}
+
+// ServerSharesResponse is /server/shares (GET).
+//
+// It is specific to mess and exposes the fair-share scheduling state.
+type ServerSharesResponse struct {
+	FairShare string           `json:"fair_share,omitempty"`
+	Shares    []SchedulerShare `json:"shares,omitempty"`
+	Now       Time             `json:"now,omitempty"`
+}
+
+// SchedulerShare is the scheduling state of a user or realm.
+type SchedulerShare struct {
+	Name    string  `json:"name"`
+	Weight  float64 `json:"weight"`
+	Pending int     `json:"pending"`
+	Running int     `json:"running"`
+	// Share is the number of running tasks relative to the weight.
+	Share float64 `json:"share"`
+}
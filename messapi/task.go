@@ -2,6 +2,7 @@ package messapi
 
 import (
 	"encoding/hex"
+	"fmt"
 	"time"
 
 	"github.com/maruel/mess/internal/model"
@@ -138,6 +139,11 @@ type TasksRequestsResponse struct {
 	Now    Time          `json:"now,omitempty"`
 }
 
+// TaskCancelRequest is /task/<id>/cancel (POST).
+type TaskCancelRequest struct {
+	KillRunning bool `json:"kill_running"`
+}
+
 // TaskCancelResponse is /task/<id>/cancel (POST).
 type TaskCancelResponse struct {
 	Ok         bool `json:"ok,omitempty"`
@@ -155,6 +161,30 @@ type TaskResultRequest struct {
 // TaskResultResponse is /task/<id>/result (GET).
 type TaskResultResponse = TaskResult
 
+// TaskQueueStatsRequest is /queues/stats (GET).
+//
+// It is specific to mess. Dimensions are "key:value" items.
+type TaskQueueStatsRequest struct {
+	Dimensions []string
+	Priority   int64
+}
+
+// TaskQueueStatsResponse is /queues/stats (GET).
+type TaskQueueStatsResponse struct {
+	Dimensions  []string `json:"dimensions,omitempty"`
+	Pending     int      `json:"pending"`
+	Bots        int      `json:"bots"`
+	WaitingBots int      `json:"waiting_bots"`
+	// Samples is the number of started tasks the averages are based on.
+	Samples              int     `json:"samples"`
+	AvgPendingSecs       float64 `json:"avg_pending_secs"`
+	AvgStartIntervalSecs float64 `json:"avg_start_interval_secs"`
+	// EstimatedStart is when a new task with the requested priority is
+	// expected to start, if known.
+	EstimatedStart Time `json:"estimated_start_ts,omitempty"`
+	Now            Time `json:"now,omitempty"`
+}
+
 // TaskStdoutRequest is /task/<id>/stdout (GET).
 type TaskStdoutRequest struct {
 	Offset int64
@@ -327,7 +357,7 @@ func (t *TaskProperties) FromDB(m *model.TaskProperties) {
 	}
 	t.Command = m.Command
 	t.RelativeWD = m.RelativeWD
-	t.Dimensions = ToStringPairs(m.Dimensions)
+	t.Dimensions = ToRepeatedStringPairs(m.Dimensions)
 	t.Env = ToStringPairs(m.Env)
 	t.EnvPrefixes = ToStringListPairs(m.EnvPrefixes)
 	t.HardTimeoutSecs.Set64(int64(m.HardTimeout / time.Second))
@@ -356,7 +386,7 @@ func (t *TaskProperties) ToDB(m *model.TaskProperties) error {
 	}
 	m.Command = t.Command
 	m.RelativeWD = t.RelativeWD
-	m.Dimensions = FromStringPairs(t.Dimensions)
+	m.Dimensions = FromRepeatedStringPairs(t.Dimensions)
 	m.Env = FromStringPairs(t.Env)
 	m.EnvPrefixes = FromStringListPairs(t.EnvPrefixes)
 	m.HardTimeout = time.Duration(t.HardTimeoutSecs.Int64()) * time.Second
@@ -388,7 +418,7 @@ func (t *TaskSlice) FromDB(m *model.TaskSlice) {
 // ToDB converts the API to the model.
 func (t *TaskSlice) ToDB(m *model.TaskSlice) error {
 	t.Properties.ToDB(&m.Properties)
-	m.Expiration = m.Expiration * time.Second
+	m.Expiration = time.Duration(t.ExpirationSecs.Int64()) * time.Second
 	m.WaitForCapacity = t.WaitForCapacity
 	return nil
 }
@@ -476,6 +506,10 @@ func (t *TaskState) FromDB(m model.TaskState) {
 		*t = "COMPLETED"
 	case model.Killed:
 		*t = "KILLED"
+	case model.Preempted:
+		// Specific to mess. It is only used in TaskResult.PreviousRuns, the task
+		// itself is requeued.
+		*t = "PREEMPTED"
 	case model.NoResource:
 		*t = "NO_RESOURCE"
 	default:
@@ -505,6 +539,17 @@ type CASOperationStats struct {
 	NumItemsHot     int     `json:"num_items_hot,omitempty"`
 }
 
+// FromDB converts the model to the API.
+func (c *CASOperationStats) FromDB(m *model.CASOperationStats) {
+	c.Duration = m.Duration.Seconds()
+	c.InitialNumItems.Set64(m.InitialNumItems)
+	c.InitialSize.Set64(m.InitialSize)
+	c.ItemsCold = m.ItemsCold
+	c.ItemsHot = m.ItemsHot
+	c.NumItemsCold = int(m.NumItemsCold)
+	c.NumItemsHot = int(m.NumItemsHot)
+}
+
 // TaskPerfStats is the performance stats for a task.
 type TaskPerfStats struct {
 	BotOverheadSecs      float64           `json:"bot_overhead,omitempty"`
@@ -518,8 +563,15 @@ type TaskPerfStats struct {
 }
 
 // FromDB converts the model to the API.
-func (t *TaskPerfStats) FromDB() {
-	// TODO(maruel): yo.
+func (t *TaskPerfStats) FromDB(m *model.TaskPerfStats) {
+	t.BotOverheadSecs = m.BotOverhead.Seconds()
+	t.CASDownload.FromDB(&m.CASDownload)
+	t.CASUpload.FromDB(&m.CASUpload)
+	t.PkgInstallation.DurationSecs = m.PkgInstallation.Seconds()
+	t.CacheTrim.DurationSecs = m.CacheTrim.Seconds()
+	t.NamnedCachesInstall.DurationSecs = m.NamedCachesInstall.Seconds()
+	t.NamedCachesUninstall.DurationSecs = m.NamedCachesUninstall.Seconds()
+	t.Cleanup.DurationSecs = m.Cleanup.Seconds()
 }
 
 // TaskResult is the result of running a TaskRequest.
@@ -554,6 +606,13 @@ type TaskResult struct {
 	RunID            model.TaskID     `json:"run_id,omitempty"`
 	CurrentTaskSlice Int              `json:"current_task_slice,omitempty"`
 	ResultDB         ResultDB         `json:"resultdb_info,omitempty"`
+	// EstimatedStart is when a pending task is expected to start. It is
+	// specific to mess and only set by /task/<id>/result.
+	EstimatedStart Time `json:"estimated_start_ts,omitempty"`
+	// PreviousRuns are the previous attempts at running the task, when its bot
+	// died or it was preempted by a task with a higher priority. It is specific
+	// to mess.
+	PreviousRuns []TaskRun `json:"previous_runs,omitempty"`
 }
 
 // FromDB converts the model to the API.
@@ -576,34 +635,59 @@ func (t *TaskResult) FromDB(r *model.TaskRequest, m *model.TaskResult, includePe
 	t.Failure = m.ExitCode != 0
 	t.InternalFailure = m.InternalFailure != ""
 	t.Modified = CloudTime(m.Modified)
-	// TODO(maruel): Use currentslice?
-	t.CASOutput.Host = r.TaskSlices[0].Properties.CASHost
+	t.CASOutput.Host = r.TaskSlices[m.CurrentTaskSlice].Properties.CASHost
 	t.CASOutput.Digest.FromDB(&m.Output)
 	t.ServerVersions = m.ServerVersions
 	t.Started = CloudTime(m.Started)
 	t.State.FromDB(m.State)
 	t.TaskID = model.ToTaskID(m.Key)
-	t.TryNumber.Set32(0)
-	if m.State != model.Pending {
-		t.TryNumber.Set32(1)
-	}
+	t.TryNumber.Set32(m.TryNumber)
 	t.CostsUSD = []float64{}
+	if m.Cost != 0 {
+		t.CostsUSD = append(t.CostsUSD, m.Cost)
+	}
 	t.Name = r.Name
 	t.Tags = r.Tags
 	t.User = r.User
 	if includePerf {
 		t.Perf = &TaskPerfStats{}
-		t.Perf.FromDB()
+		t.Perf.FromDB(&m.Perf)
 	}
 	t.CIPDPins.ClientPkg.FromDB(&m.CIPDClientUsed)
 	t.CIPDPins.Pkgs = make([]CIPDPackage, len(m.CIPDPins))
 	for i := range m.CIPDPins {
 		t.CIPDPins.Pkgs[i].FromDB(&m.CIPDPins[i])
 	}
-	t.RunID = t.TaskID // No difference in mess.
+	t.RunID = model.ToRunID(m.Key, m.TryNumber)
 	t.CurrentTaskSlice.Set32(m.CurrentTaskSlice)
 	t.ResultDB.Host = m.ResultDB.Host
 	t.ResultDB.Invocation = m.ResultDB.Invocation
+	t.PreviousRuns = make([]TaskRun, len(m.PreviousRuns))
+	for i := range m.PreviousRuns {
+		t.PreviousRuns[i].FromDB(&m.PreviousRuns[i])
+	}
+}
+
+// TaskRun is a previous attempt at running a task. It is specific to mess.
+type TaskRun struct {
+	TryNumber       Int       `json:"try_number,omitempty"`
+	BotID           string    `json:"bot_id,omitempty"`
+	BotVersion      string    `json:"bot_version,omitempty"`
+	State           TaskState `json:"state,omitempty"`
+	InternalFailure string    `json:"internal_failure,omitempty"`
+	Started         Time      `json:"started_ts,omitempty"`
+	Abandoned       Time      `json:"abandoned_ts,omitempty"`
+}
+
+// FromDB converts the model to the API.
+func (t *TaskRun) FromDB(m *model.TaskRun) {
+	t.TryNumber.Set32(m.TryNumber)
+	t.BotID = m.BotID
+	t.BotVersion = m.BotVersion
+	t.State.FromDB(m.State)
+	t.InternalFailure = m.InternalFailure
+	t.Started = CloudTime(m.Started)
+	t.Abandoned = CloudTime(m.Abandoned)
 }
 
 //
@@ -611,6 +695,42 @@ func (t *TaskResult) FromDB(r *model.TaskRequest, m *model.TaskResult, includePe
 // TaskStateQuery is TODO. Default is ALL
 type TaskStateQuery = string
 
+// ToTaskStateQuery converts the API to the model.
+func ToTaskStateQuery(q TaskStateQuery) (model.TaskStateQuery, error) {
+	switch q {
+	case "PENDING":
+		return model.TaskStateQueryPending, nil
+	case "RUNNING":
+		return model.TaskStateQueryRunning, nil
+	case "PENDING_RUNNING":
+		return model.TaskStateQueryPendingRunning, nil
+	case "COMPLETED":
+		return model.TaskStateQueryCompleted, nil
+	case "COMPLETED_SUCCESS":
+		return model.TaskStateQueryCompletedSuccess, nil
+	case "COMPLETED_FAILURE":
+		return model.TaskStateQueryCompletedFailure, nil
+	case "EXPIRED":
+		return model.TaskStateQueryExpired, nil
+	case "TIMED_OUT":
+		return model.TaskStateQueryTimedOut, nil
+	case "BOT_DIED":
+		return model.TaskStateQueryBotDied, nil
+	case "CANCELED":
+		return model.TaskStateQueryCanceled, nil
+	case "", "ALL":
+		return model.TaskStateQueryAll, nil
+	case "DEDUPED":
+		return model.TaskStateQueryDeduped, nil
+	case "KILLED":
+		return model.TaskStateQueryKilled, nil
+	case "NO_RESOURCE":
+		return model.TaskStateQueryNoResource, nil
+	default:
+		return model.TaskStateQueryAll, fmt.Errorf("invalid state %q", q)
+	}
+}
+
 // TaskSort is TODO. Default is CREATED_TS
 type TaskSort = string
 
@@ -618,4 +738,13 @@ type TaskSort = string
 type TaskQueue struct {
 	Dimensions []string `json:"dimensions,omitempty"`
 	ValidUntil Time     `json:"valid_until_ts,omitempty"`
+
+	// The following are specific to mess.
+
+	// Pending is the number of pending tasks.
+	Pending int `json:"pending,omitempty"`
+	// OldestPendingSecs is the age of the oldest pending task.
+	OldestPendingSecs float64 `json:"oldest_pending_secs,omitempty"`
+	// Bots is the number of known bots that can run the tasks.
+	Bots int `json:"bots,omitempty"`
 }